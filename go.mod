@@ -6,6 +6,7 @@ require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/labstack/echo v3.3.10+incompatible
 	github.com/mattn/go-sqlite3 v1.11.0
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/segmentio/ksuid v1.0.2
 	gopkg.in/tucnak/telebot.v2 v2.5.0
 )
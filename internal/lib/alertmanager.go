@@ -0,0 +1,26 @@
+package lib
+
+// Alertmanager webhook payload, only the fields used here
+type alertmanagerPayload struct {
+	Version string              `json:"version"`
+	Status  string              `json:"status"`
+	Alerts  []alertmanagerAlert `json:"alerts"`
+}
+
+type alertmanagerAlert struct {
+	Status string            `json:"status"`
+	Labels map[string]string `json:"labels"`
+}
+
+// Name of the always firing alert of the Prometheus default rules
+const DefaultAlertName = "Watchdog"
+
+// firing tells whether the payload has a firing alert with the name.
+func (p *alertmanagerPayload) firing(alertname string) bool {
+	for _, a := range p.Alerts {
+		if a.Status == "firing" && a.Labels["alertname"] == alertname {
+			return true
+		}
+	}
+	return false
+}
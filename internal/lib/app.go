@@ -2,6 +2,7 @@ package lib
 
 import (
 	"log"
+	"os"
 	"sync"
 	"time"
 
@@ -22,7 +23,14 @@ func (a *App) Initialize(dbParameters, token, prefix, hmacSecret string) {
 	a.Rest = NewRestServer(prefix, a.DB, hmacSecret)
 
 	// Telegram Bot
+	TgWebhook = TelegramWebhookConfigFromEnv()
 	InitTelegram(token, a.DB)
+
+	// Email
+	InitEmail(SmtpConfigFromEnv())
+
+	// Metrics
+	MetricsToken = os.Getenv("METRICS_TOKEN")
 }
 
 func (a *App) Run(bindParameter string) {
@@ -35,6 +43,17 @@ func (a *App) Run(bindParameter string) {
 	go func() {
 		for _ = range ticker.C {
 			a.DB.ProcessExpiredTimers()
+			a.DB.ProcessReminders()
+		}
+	}()
+
+	// Outbox retries and digests have their own ticker, as slow channels
+	// would delay the expiry of the timers
+	outboxTicker := time.NewTicker(3 * time.Second)
+	go func() {
+		for _ = range outboxTicker.C {
+			a.DB.ProcessDigests()
+			a.DB.ProcessOutbox()
 		}
 	}()
 
@@ -0,0 +1,379 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// botCommand handles a bot command of a registered user and returns the
+// reply. args is the text after the command.
+type botCommand func(db *Database, userid int64, args string) string
+
+var botCommands = map[string]botCommand{
+	"/list":   botList,
+	"/status": botStatus,
+	"/kick":   botKick,
+	"/new":    botNew,
+	"/delete": botDelete,
+	"/pause":  botPause,
+	"/resume": botResume,
+	"/digest": botDigest,
+}
+
+// chatCommand is a bot command that depends on the chat it was sent in.
+type chatCommand func(db *Database, userid int64, chat *tb.Chat, args string) string
+
+var chatCommands = map[string]chatCommand{
+	"/bind":   botBind,
+	"/unbind": botUnbind,
+	"/newkey": botNewKey,
+}
+
+// Origin of the bot's changes in the event log
+var botSource = &EventSource{UserAgent: "Telegram"}
+
+func runBotCommand(db *Database, tgid int64, handler botCommand, args string) string {
+	userid, err := db.GetUserIdByTelegramId(tgid)
+	if err != nil {
+		return "Unknown user, send /start first"
+	}
+	return handler(db, userid, strings.TrimSpace(args))
+}
+
+func runChatCommand(db *Database, tgid int64, chat *tb.Chat, handler chatCommand, args string) string {
+	userid, err := db.GetUserIdByTelegramId(tgid)
+	if err != nil {
+		return "Unknown user, send /start first"
+	}
+	return handler(db, userid, chat, strings.TrimSpace(args))
+}
+
+// describe returns a one-line summary of the timer state.
+func (t *Timer) describe(now time.Time) string {
+	s := fmt.Sprintf("%s: %s", t.Name, t.State)
+	left := time.Duration(t.Expiry-now.Unix()) * time.Second
+	switch t.State {
+	case "running", "started":
+		s += fmt.Sprintf(", expires in %s", left)
+	case "late", "expired", "failed":
+		s += fmt.Sprintf(", down for %s", -left)
+	}
+	return s
+}
+
+// botTimer returns the named timer or the reply telling why it was not found.
+func botTimer(db *Database, userid int64, name, usage string) (*Timer, string) {
+	if name == "" {
+		return nil, "Usage: " + usage
+	}
+	t := db.GetTimerByName(userid, name)
+	if t == nil {
+		return nil, fmt.Sprintf("Timer '%s' not found", name)
+	}
+	t.Source = botSource
+	return t, ""
+}
+
+func botList(db *Database, userid int64, args string) string {
+	ts := db.GetTimers(userid)
+	if len(ts) == 0 {
+		return "No timers"
+	}
+
+	now := time.Now()
+	lines := make([]string, len(ts))
+	for i, t := range ts {
+		lines[i] = t.describe(now)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func botStatus(db *Database, userid int64, args string) string {
+	t, reply := botTimer(db, userid, args, "/status <name>")
+	if t == nil {
+		return reply
+	}
+
+	lines := []string{t.describe(time.Now())}
+	if t.Schedule != "" {
+		lines = append(lines, fmt.Sprintf("Schedule: %s %s", t.Schedule, t.Timezone))
+	} else {
+		lines = append(lines, fmt.Sprintf("Interval: %s", time.Duration(t.Interval)*time.Second))
+	}
+	if grace := t.effectiveGrace(); grace > 0 {
+		lines = append(lines, fmt.Sprintf("Grace: %s", time.Duration(grace)*time.Second))
+	}
+	if t.Kicked > 0 {
+		lines = append(lines, "Last kick: "+time.Unix(t.Kicked, 0).UTC().Format("2006-01-02 15:04:05 MST"))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func botKick(db *Database, userid int64, args string) string {
+	t, reply := botTimer(db, userid, args, "/kick <name>")
+	if t == nil {
+		return reply
+	}
+	if err := t.Kick(); err != nil {
+		return "Failed to kick timer: " + err.Error()
+	}
+	return fmt.Sprintf("Timer '%s' kicked", t.Name)
+}
+
+// parseBotInterval accepts seconds or a duration such as "1h30m".
+func parseBotInterval(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return int64(d / time.Second), nil
+}
+
+func botNew(db *Database, userid int64, args string) string {
+	const usage = "Usage: /new <name> <interval>"
+	i := strings.LastIndexAny(args, " \t")
+	if i < 0 {
+		return usage
+	}
+	name := strings.TrimSpace(args[:i])
+	interval, err := parseBotInterval(args[i+1:])
+	if name == "" || err != nil {
+		return usage
+	}
+
+	t := db.NewTimer()
+	t.UserId = userid
+	t.Name = name
+	t.Interval = interval
+	t.Source = botSource
+	if err := t.Validate(); err != nil {
+		return err.Error()
+	}
+	if err := t.Create(); err != nil {
+		return "Failed to create timer"
+	}
+	return fmt.Sprintf("Timer '%s' created, kick it to start", t.Name)
+}
+
+func botDelete(db *Database, userid int64, args string) string {
+	t, reply := botTimer(db, userid, args, "/delete <name>")
+	if t == nil {
+		return reply
+	}
+	if err := t.Delete(); err != nil {
+		return "Failed to delete timer"
+	}
+	return fmt.Sprintf("Timer '%s' deleted", t.Name)
+}
+
+func botPause(db *Database, userid int64, args string) string {
+	t, reply := botTimer(db, userid, args, "/pause <name>")
+	if t == nil {
+		return reply
+	}
+	if err := t.Pause(); err != nil {
+		return "Failed to pause timer"
+	}
+	return fmt.Sprintf("Timer '%s' paused", t.Name)
+}
+
+func botResume(db *Database, userid int64, args string) string {
+	t, reply := botTimer(db, userid, args, "/resume <name>")
+	if t == nil {
+		return reply
+	}
+	if err := t.Resume(); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("Timer '%s' resumed", t.Name)
+}
+
+// botDigest shows, sets or disables the digest schedule, or sends the
+// digest right away.
+func botDigest(db *Database, userid int64, args string) string {
+	const usage = "Usage: /digest <schedule> [timezone] | off | now"
+	ds, err := db.GetDigestSettings(userid)
+	if err != nil {
+		return "Failed to get digest settings"
+	}
+
+	switch args {
+	case "":
+		if ds.Schedule == "" {
+			return "No digest scheduled\n" + usage
+		}
+		next := time.Unix(ds.Next, 0).In(ds.location()).Format("2006-01-02 15:04 MST")
+		return fmt.Sprintf("Digest schedule: %s %s\nNext digest: %s", ds.Schedule, ds.Timezone, next)
+	case "off":
+		if _, err := db.SetDigestSchedule(userid, "", ""); err != nil {
+			return "Failed to disable digest"
+		}
+		return "Digest disabled"
+	case "now":
+		now := time.Now().Unix()
+		from := ds.Last
+		if from == 0 {
+			from = now - DefaultDigestPeriod
+		}
+		return db.Digest(userid, from, now, ds.location())
+	}
+
+	// The timezone is an optional last field after the schedule
+	schedule, timezone := args, ""
+	if _, _, err := parseSchedule(schedule, ""); err != nil {
+		if i := strings.LastIndexAny(args, " \t"); i >= 0 {
+			schedule, timezone = strings.TrimSpace(args[:i]), args[i+1:]
+		}
+	}
+	ds, err = db.SetDigestSchedule(userid, schedule, timezone)
+	if err != nil {
+		return err.Error()
+	}
+	next := time.Unix(ds.Next, 0).In(ds.location()).Format("2006-01-02 15:04 MST")
+	return fmt.Sprintf("Digest scheduled, next digest: %s", next)
+}
+
+// alertAction handles an alert button pressed by a registered user and
+// returns the answer shown to the user. by names the user.
+type alertAction func(t *Timer, by string) string
+
+// Buttons attached to the alert messages, the timer ID is the button data
+var alertButtons = []struct {
+	unique string
+	text   string
+	action alertAction
+}{
+	{"ack", "Acknowledge", alertAck},
+	{"snooze", "Snooze 1h", alertSnooze},
+	{"kick", "Kick now", alertKick},
+}
+
+// runAlertAction runs the action on a timer of the user who pressed the
+// button, or of a user who has bound the chat of the alert.
+func runAlertAction(db *Database, tgid, chatId int64, by string, handler alertAction, data string) string {
+	id, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return "Timer not found"
+	}
+
+	var t *Timer
+	if userid, err := db.GetUserIdByTelegramId(tgid); err == nil {
+		t = db.GetTimer(id, userid)
+	}
+	for _, userid := range db.telegramChatUsers(chatId) {
+		if t != nil {
+			break
+		}
+		// Only timers alerting the chat can be handled from it
+		if x := db.GetTimer(id, userid); x != nil && x.alertsTo(db.telegramChatChannels(userid, chatId)) {
+			t = x
+		}
+	}
+	if t == nil {
+		return "Timer not found"
+	}
+	t.Source = &EventSource{UserAgent: "Telegram " + by}
+	return handler(t, by)
+}
+
+// alertsTo tells whether the timer notifies one of the channels. A timer
+// without channels notifies all of them.
+func (t *Timer) alertsTo(cs []*Channel) bool {
+	if len(t.Channels) == 0 {
+		return len(cs) > 0
+	}
+	for _, c := range cs {
+		for _, name := range t.Channels {
+			if c.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func alertAck(t *Timer, by string) string {
+	if err := t.Acknowledge(by); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("Timer '%s' acknowledged", t.Name)
+}
+
+func alertSnooze(t *Timer, by string) string {
+	if err := t.Snooze(by, 3600); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("Timer '%s' snoozed for 1h", t.Name)
+}
+
+func alertKick(t *Timer, by string) string {
+	if err := t.Kick(); err != nil {
+		return "Failed to kick timer: " + err.Error()
+	}
+	return fmt.Sprintf("Timer '%s' kicked", t.Name)
+}
+
+// botBind adds the group chat as a notification channel of the user. The
+// channel is named after the group unless a name is given.
+func botBind(db *Database, userid int64, chat *tb.Chat, args string) string {
+	if chat.Type == tb.ChatPrivate {
+		return "Use /bind in a group chat"
+	}
+	if cs := db.telegramChatChannels(userid, chat.ID); len(cs) > 0 {
+		return fmt.Sprintf("This chat is already bound as channel '%s'", cs[0].Name)
+	}
+
+	name := args
+	if name == "" {
+		name = chat.Title
+	}
+	config, _ := json.Marshal(telegramConfig{ChatId: chat.ID})
+
+	c := db.NewChannel()
+	c.UserId = userid
+	c.Name = name
+	c.Kind = "telegram"
+	c.Config = config
+	if err := c.Validate(); err != nil {
+		return err.Error()
+	}
+	if db.GetChannel(userid, name) != nil {
+		return fmt.Sprintf("Channel '%s' already exists, usage: /bind <name>", name)
+	}
+	if err := c.Create(); err != nil {
+		return "Failed to bind chat"
+	}
+	return fmt.Sprintf("Chat bound as channel '%s', add it to the channels of a timer to send its alerts here", c.Name)
+}
+
+func botUnbind(db *Database, userid int64, chat *tb.Chat, args string) string {
+	cs := db.telegramChatChannels(userid, chat.ID)
+	if len(cs) == 0 {
+		return "This chat is not bound"
+	}
+	for _, c := range cs {
+		if err := c.Delete(); err != nil {
+			return "Failed to unbind chat"
+		}
+	}
+	return "Chat unbound"
+}
+
+func botNewKey(db *Database, userid int64, chat *tb.Chat, args string) string {
+	if chat.Type != tb.ChatPrivate {
+		return "Use /newkey in a private chat"
+	}
+	key, err := db.RotateUserKey(userid)
+	if err != nil {
+		return "Failed to rotate key"
+	}
+	return fmt.Sprintf("Your new access key:\n%s\nThe old key and its sessions no longer work", key)
+}
@@ -3,8 +3,10 @@ package lib
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -20,6 +22,11 @@ type User struct {
 	Name string
 	TgId int64
 	Key  string
+	// Incremented when the key is rotated, revoking the old sessions
+	Generation int64
+	// Secret of the ping URLs, see ping.go
+	PingKey    string
+	AutoCreate bool
 }
 
 type Timer struct {
@@ -27,13 +34,39 @@ type Timer struct {
 	Id       int64  `json:"timerid"`
 	UserId   int64  `json:"-"`
 	Name     string `json:"name" form:"name" query:"name"`
+	Slug     string `json:"slug" form:"slug" query:"slug"` // Name in the ping URLs, unique per user
+	UUID     string `json:"uuid"`                          // Alternative ID in the ping URLs
 	Interval int64  `json:"interval" form:"interval" query:"interval"`
-	Expiry   int64  `json:"expiry"`
-	// State can be "new", "running", "expired"
+	Grace    int64  `json:"grace" form:"grace" query:"grace"`
+	// Cron schedule used instead of the interval when set
+	Schedule string `json:"schedule" form:"schedule" query:"schedule"`
+	Timezone string `json:"timezone" form:"timezone" query:"timezone"`
+	// Longest allowed run between a start ping and the following kick
+	MaxRuntime int64 `json:"max_runtime" form:"max_runtime" query:"max_runtime"`
+	Started    int64 `json:"started"`
+	// Time of the last successful kick
+	Kicked int64 `json:"kicked"`
+	// Reminder policy while the timer is expired or failed. Reminders are
+	// sent every Reminder seconds (doubling each time with backoff), at most
+	// ReminderMax times if set.
+	Reminder        int64 `json:"reminder" form:"reminder" query:"reminder"`
+	ReminderMax     int64 `json:"reminder_max" form:"reminder_max" query:"reminder_max"`
+	ReminderBackoff bool  `json:"reminder_backoff" form:"reminder_backoff" query:"reminder_backoff"`
+	Reminders       int64 `json:"reminders"`
+	NextReminder    int64 `json:"next_reminder"`
+	// Time and user of the acknowledgement of the current alert
+	Acked   int64  `json:"acked"`
+	AckedBy string `json:"acked_by"`
+	// Names of the notification channels, all of the user's channels if empty
+	Channels []string `json:"channels" form:"channels" query:"channels"`
+	Expiry   int64    `json:"expiry"`
+	// State can be "new", "running", "started", "late", "expired", "failed", "paused"
 	State string `json:"state"`
 
 	// Other
 	Database *Database `json:"-"`
+	// Origin of the changes, logged in the events
+	Source *EventSource `json:"-"`
 }
 
 func NewDatabase(dbParameters string) *Database {
@@ -49,6 +82,16 @@ func NewDatabase(dbParameters string) *Database {
 }
 
 func (p *Database) Init() {
+	// The original Event table (one row per timer) was never written to
+	if p.tableExists("Event") && !p.hasColumn("Event", "type") {
+		if _, err := p.db.Exec(`DROP TABLE Event`); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	newChannelTable := !p.tableExists("Channel")
+	newTokenTable := !p.tableExists("Token")
+
 	// Initialize database
 	qs := [...]string{
 		`CREATE TABLE IF NOT EXISTS User (
@@ -56,24 +99,112 @@ func (p *Database) Init() {
 			tgname TEXT NOT NULL,
 			tgid   TEXT NOT NULL UNIQUE,
 			key    TEXT NOT NULL,
+			generation INTEGER NOT NULL DEFAULT 0,
+			ping_key   TEXT NOT NULL DEFAULT '',
+			auto_create INTEGER NOT NULL DEFAULT 0,
+			digest_schedule TEXT NOT NULL DEFAULT '',
+			digest_timezone TEXT NOT NULL DEFAULT '',
+			next_digest INTEGER NOT NULL DEFAULT 0,
+			last_digest INTEGER NOT NULL DEFAULT 0,
 			ts     DATETIME DEFAULT CURRENT_TIMESTAMP
 		)`,
 		`CREATE TABLE IF NOT EXISTS Timer (
 			id        INTEGER PRIMARY KEY AUTOINCREMENT,
 			user_id   INTEGER NOT NULL,
 			name      TEXT NOT NULL,
+			slug      TEXT NOT NULL DEFAULT '',
+			uuid      TEXT NOT NULL DEFAULT '',
 			interval  INTEGER NOT NULL,
+			grace     INTEGER NOT NULL DEFAULT 0,
+			schedule  TEXT NOT NULL DEFAULT '',
+			timezone  TEXT NOT NULL DEFAULT '',
+			max_runtime INTEGER NOT NULL DEFAULT 0,
+			started   INTEGER NOT NULL DEFAULT 0,
+			kicked    INTEGER NOT NULL DEFAULT 0,
+			reminder  INTEGER NOT NULL DEFAULT 0,
+			reminder_max INTEGER NOT NULL DEFAULT 0,
+			reminder_backoff INTEGER NOT NULL DEFAULT 0,
+			reminders INTEGER NOT NULL DEFAULT 0,
+			next_reminder INTEGER NOT NULL DEFAULT 0,
+			acked     INTEGER NOT NULL DEFAULT 0,
+			acked_by  TEXT NOT NULL DEFAULT '',
+			channels  TEXT NOT NULL DEFAULT '[]',
 			expiry    INTEGER NOT NULL,
 			state     TEXT NOT NULL,
 			ts        DATETIME DEFAULT CURRENT_TIMESTAMP
 		)`,
 		`CREATE TABLE IF NOT EXISTS Event (
-			timer_id INTEGER PRIMARY KEY,
-			ts       DATETIME DEFAULT CURRENT_TIMESTAMP
+			id       INTEGER PRIMARY KEY AUTOINCREMENT,
+			timer_id INTEGER NOT NULL,
+			user_id  INTEGER NOT NULL DEFAULT 0,
+			type     TEXT NOT NULL,
+			from_state TEXT NOT NULL DEFAULT '',
+			state    TEXT NOT NULL DEFAULT '',
+			duration INTEGER NOT NULL DEFAULT 0,
+			exit_code INTEGER NOT NULL DEFAULT -1,
+			source_ip TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			ts       INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS EventIndexTimer
+			ON Event (timer_id, id)
+		`,
+		`CREATE TABLE IF NOT EXISTS Channel (
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id   INTEGER NOT NULL,
+			name      TEXT NOT NULL,
+			kind      TEXT NOT NULL,
+			config    TEXT NOT NULL DEFAULT '{}',
+			ts        DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (user_id, name)
+		)`,
+		`CREATE TABLE IF NOT EXISTS Outbox (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id      INTEGER NOT NULL,
+			channel_id   INTEGER NOT NULL,
+			channel      TEXT NOT NULL,
+			payload      TEXT NOT NULL,
+			state        TEXT NOT NULL,
+			attempts     INTEGER NOT NULL DEFAULT 0,
+			next_attempt INTEGER NOT NULL DEFAULT 0,
+			last_error   TEXT NOT NULL DEFAULT '',
+			created      INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS OutboxIndexNextAttempt
+			ON Outbox (next_attempt)
+			WHERE state='pending'
+		`,
+		`CREATE TABLE IF NOT EXISTS Maintenance (
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id   INTEGER NOT NULL,
+			name      TEXT NOT NULL,
+			start     INTEGER NOT NULL DEFAULT 0,
+			end       INTEGER NOT NULL DEFAULT 0,
+			schedule  TEXT NOT NULL DEFAULT '',
+			timezone  TEXT NOT NULL DEFAULT '',
+			duration  INTEGER NOT NULL DEFAULT 0,
+			ts        DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS MaintenanceTimer (
+			maintenance_id INTEGER NOT NULL,
+			timer_id       INTEGER NOT NULL,
+			PRIMARY KEY (maintenance_id, timer_id)
 		)`,
-		`CREATE INDEX IF NOT EXISTS TimerIndexExpiry
+		`CREATE TABLE IF NOT EXISTS Token (
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			timer_id  INTEGER NOT NULL,
+			user_id   INTEGER NOT NULL,
+			jti       TEXT NOT NULL UNIQUE,
+			name      TEXT NOT NULL,
+			expiry    INTEGER NOT NULL DEFAULT 0,
+			created   INTEGER NOT NULL,
+			UNIQUE (timer_id, name)
+		)`,
+		// Replaced by TimerIndexExpiryActive
+		`DROP INDEX IF EXISTS TimerIndexExpiry`,
+		`CREATE INDEX IF NOT EXISTS TimerIndexExpiryActive
 			ON Timer (expiry)
-			WHERE state="running"
+			WHERE state IN ('running', 'started', 'late')
 		`,
 	}
 	for _, q := range qs {
@@ -82,9 +213,115 @@ func (p *Database) Init() {
 			log.Fatalf("%q: %s\n", err, q)
 		}
 	}
+
+	// Columns added after the initial schema
+	p.addColumn("User", "generation", "INTEGER NOT NULL DEFAULT 0")
+	p.addColumn("User", "ping_key", "TEXT NOT NULL DEFAULT ''")
+	p.addColumn("User", "auto_create", "INTEGER NOT NULL DEFAULT 0")
+	p.addColumn("User", "digest_schedule", "TEXT NOT NULL DEFAULT ''")
+	p.addColumn("User", "digest_timezone", "TEXT NOT NULL DEFAULT ''")
+	p.addColumn("User", "next_digest", "INTEGER NOT NULL DEFAULT 0")
+	p.addColumn("User", "last_digest", "INTEGER NOT NULL DEFAULT 0")
+	p.addColumn("Event", "user_id", "INTEGER NOT NULL DEFAULT 0")
+	p.addColumn("Event", "from_state", "TEXT NOT NULL DEFAULT ''")
+	p.addColumn("Event", "state", "TEXT NOT NULL DEFAULT ''")
+	p.addColumn("Event", "exit_code", "INTEGER NOT NULL DEFAULT -1")
+	p.addColumn("Event", "source_ip", "TEXT NOT NULL DEFAULT ''")
+	p.addColumn("Event", "user_agent", "TEXT NOT NULL DEFAULT ''")
+	p.addColumn("Timer", "grace", "INTEGER NOT NULL DEFAULT 0")
+	p.addColumn("Timer", "schedule", `TEXT NOT NULL DEFAULT ''`)
+	p.addColumn("Timer", "timezone", `TEXT NOT NULL DEFAULT ''`)
+	p.addColumn("Timer", "max_runtime", "INTEGER NOT NULL DEFAULT 0")
+	p.addColumn("Timer", "started", "INTEGER NOT NULL DEFAULT 0")
+	p.addColumn("Timer", "kicked", "INTEGER NOT NULL DEFAULT 0")
+	p.addColumn("Timer", "reminder", "INTEGER NOT NULL DEFAULT 0")
+	p.addColumn("Timer", "reminder_max", "INTEGER NOT NULL DEFAULT 0")
+	p.addColumn("Timer", "reminder_backoff", "INTEGER NOT NULL DEFAULT 0")
+	p.addColumn("Timer", "reminders", "INTEGER NOT NULL DEFAULT 0")
+	p.addColumn("Timer", "next_reminder", "INTEGER NOT NULL DEFAULT 0")
+	p.addColumn("Timer", "channels", "TEXT NOT NULL DEFAULT '[]'")
+	p.addColumn("Timer", "acked", "INTEGER NOT NULL DEFAULT 0")
+	p.addColumn("Timer", "acked_by", "TEXT NOT NULL DEFAULT ''")
+	p.addColumn("Timer", "slug", "TEXT NOT NULL DEFAULT ''")
+	p.addColumn("Timer", "uuid", "TEXT NOT NULL DEFAULT ''")
+	p.initPing()
+
+	// Existing users were notified over Telegram before channels
+	if newChannelTable {
+		rows, err := p.db.Query(`SELECT id FROM User`)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ids := []int64{}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				log.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		for _, id := range ids {
+			if err := p.createDefaultChannel(id); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	// Kick URLs issued before stored tokens keep working until revoked
+	if newTokenTable {
+		p.createLegacyTokens()
+	}
+
 	log.Println("Database initialized")
 }
 
+func (p *Database) tableExists(table string) bool {
+	var name string
+	err := p.db.QueryRow(`SELECT name FROM sqlite_master WHERE type='table' AND name=?`, table).Scan(&name)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return true
+}
+
+func (p *Database) hasColumn(table, column string) bool {
+	rows, err := p.db.Query(`PRAGMA table_info(` + table + `)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			log.Fatal(err)
+		}
+		if name == column {
+			return true
+		}
+	}
+	return false
+}
+
+// addColumn adds a column to an existing table unless it is already there.
+func (p *Database) addColumn(table, column, definition string) {
+	if p.hasColumn(table, column) {
+		return
+	}
+
+	q := `ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition
+	if _, err := p.db.Exec(q); err != nil {
+		log.Fatalf("%q: %s\n", err, q)
+	}
+	log.Println("Database column added:", table, column)
+}
+
 func (p *Database) Close() {
 	p.db.Close()
 }
@@ -96,21 +333,54 @@ func (p *Database) GetUserIdByKey(key string) (id int64, err error) {
 	return
 }
 
+func (p *Database) GetUserIdByTelegramId(tgid int64) (id int64, err error) {
+	err = p.db.QueryRow(`SELECT id FROM User WHERE tgid=?`, tgid).Scan(&id)
+	return id, err
+}
+
 func (p *Database) GetUserTelegramIdById(id int64) (tgid int64, err error) {
 	err = p.db.QueryRow(`SELECT tgid FROM User WHERE id=? LIMIT 1`, id).Scan(&tgid)
 	return tgid, err
 }
 
+func (p *Database) GetUserGeneration(id int64) (gen int64, err error) {
+	err = p.db.QueryRow(`SELECT generation FROM User WHERE id=?`, id).Scan(&gen)
+	return gen, err
+}
+
+// RotateUserKey replaces the access key of the user. The sessions logged
+// in before are revoked by incrementing the generation.
+func (p *Database) RotateUserKey(id int64) (string, error) {
+	key := ksuid.New().String()
+	res, err := p.db.Exec(`UPDATE User SET key=?, generation=generation+1 WHERE id=?`, key, id)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", errors.New("User not found")
+	}
+	log.Println("Database.RotateUserKey", id)
+	return key, nil
+}
+
 func (p *Database) CreateOrGetUserKeyByTelegramId(u *User) bool {
-	row := p.db.QueryRow(`SELECT key FROM User WHERE tgid=?`, u.TgId)
-	err := row.Scan(&u.Key)
+	row := p.db.QueryRow(`SELECT id, key, ping_key, auto_create FROM User WHERE tgid=?`, u.TgId)
+	err := row.Scan(&u.Id, &u.Key, &u.PingKey, &u.AutoCreate)
 	switch err {
 	case sql.ErrNoRows:
 		u.Key = ksuid.New().String()
-		_, err := p.db.Exec(`INSERT INTO User (tgname, tgid, key) VALUES (?, ?, ?)`, u.Name, u.TgId, u.Key)
+		u.PingKey = ksuid.New().String()
+		res, err := p.db.Exec(`INSERT INTO User (tgname, tgid, key, ping_key) VALUES (?, ?, ?, ?)`, u.Name, u.TgId, u.Key, u.PingKey)
+		if err != nil {
+			log.Panic(err)
+		}
+		u.Id, err = res.LastInsertId()
 		if err != nil {
 			log.Panic(err)
 		}
+		if err := p.createDefaultChannel(u.Id); err != nil {
+			log.Panic(err)
+		}
 		return true
 	case nil:
 		return false
@@ -123,18 +393,47 @@ func (p *Database) CreateOrGetUserKeyByTelegramId(u *User) bool {
 func (p *Database) NewTimer() *Timer {
 	t := &Timer{
 		State:    "new",
+		Channels: []string{},
 		Database: p,
 	}
 	return t
 }
 
-func (p *Database) GetTimer(id, userid int64) *Timer {
-	row := p.db.QueryRow(`SELECT name, interval, expiry, state FROM Timer WHERE id=? AND user_id=?`, id, userid)
+// Columns read by scanTimer, in order
+const timerColumns = `id, user_id, name, slug, uuid, interval, grace, schedule, timezone, max_runtime, started, kicked,
+	reminder, reminder_max, reminder_backoff, reminders, next_reminder, acked, acked_by, channels, expiry, state`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
 
+func (p *Database) scanTimer(row scanner) (*Timer, error) {
 	t := p.NewTimer()
-	t.Id = id
-	t.UserId = userid
-	err := row.Scan(&t.Name, &t.Interval, &t.Expiry, &t.State)
+	var channels string
+	err := row.Scan(&t.Id, &t.UserId, &t.Name, &t.Slug, &t.UUID, &t.Interval, &t.Grace, &t.Schedule, &t.Timezone, &t.MaxRuntime, &t.Started, &t.Kicked,
+		&t.Reminder, &t.ReminderMax, &t.ReminderBackoff, &t.Reminders, &t.NextReminder, &t.Acked, &t.AckedBy, &channels, &t.Expiry, &t.State)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(channels), &t.Channels); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// channelsJSON returns the channel names as stored in the database.
+func (t *Timer) channelsJSON() string {
+	if t.Channels == nil {
+		return "[]"
+	}
+	x, _ := json.Marshal(t.Channels)
+	return string(x)
+}
+
+func (p *Database) GetTimer(id, userid int64) *Timer {
+	row := p.db.QueryRow(`SELECT `+timerColumns+` FROM Timer WHERE id=? AND user_id=?`, id, userid)
+
+	t, err := p.scanTimer(row)
 
 	if err != nil {
 		log.Println("WARNING: Timer.Get", id, userid, err)
@@ -144,16 +443,43 @@ func (p *Database) GetTimer(id, userid int64) *Timer {
 	return t
 }
 
+func (p *Database) GetTimers(userid int64) []*Timer {
+	ts := []*Timer{}
+	rows, err := p.db.Query(`SELECT `+timerColumns+` FROM Timer WHERE user_id=? ORDER BY id`, userid)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t, err := p.scanTimer(rows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+// GetTimerByName returns the user's oldest timer with the name.
+func (p *Database) GetTimerByName(userid int64, name string) *Timer {
+	row := p.db.QueryRow(`SELECT `+timerColumns+` FROM Timer WHERE user_id=? AND name=? ORDER BY id LIMIT 1`, userid, name)
+	t, err := p.scanTimer(row)
+	if err != nil {
+		return nil
+	}
+	return t
+}
+
 func (p *Database) GetTimersJSON(userid int64) string {
 	s := ""
-	rows, err := p.db.Query(`SELECT id, name, interval, expiry, state FROM Timer WHERE user_id=?`, userid)
+	rows, err := p.db.Query(`SELECT `+timerColumns+` FROM Timer WHERE user_id=?`, userid)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer rows.Close()
 	for rows.Next() {
-		var t Timer
-		t.UserId = userid
-		if err := rows.Scan(&t.Id, &t.Name, &t.Interval, &t.Expiry, &t.State); err != nil {
+		t, err := p.scanTimer(rows)
+		if err != nil {
 			log.Fatal(err)
 		}
 		var x []byte
@@ -169,12 +495,28 @@ func (p *Database) GetTimersJSON(userid int64) string {
 
 // Timer entries
 func (t *Timer) Create() error {
+	if t.Slug == "" {
+		t.Slug = t.Database.uniqueSlug(t.UserId, 0, slugify(t.Name))
+	}
+	t.UUID = newUUID()
+
 	res, err := t.Database.db.Exec(
-		`INSERT INTO Timer (user_id, name, interval, expiry, state) 
-		VALUES (?, ?, ?, ?, ?)`,
+		`INSERT INTO Timer (user_id, name, slug, uuid, interval, grace, schedule, timezone, max_runtime,
+			reminder, reminder_max, reminder_backoff, channels, expiry, state) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		t.UserId,
 		t.Name,
+		t.Slug,
+		t.UUID,
 		t.Interval,
+		t.Grace,
+		t.Schedule,
+		t.Timezone,
+		t.MaxRuntime,
+		t.Reminder,
+		t.ReminderMax,
+		t.ReminderBackoff,
+		t.channelsJSON(),
 		t.Expiry,
 		t.State,
 	)
@@ -189,9 +531,139 @@ func (t *Timer) Create() error {
 	}
 
 	log.Println("Timer.Create", t)
-	tgid, _ := t.Database.GetUserTelegramIdById(t.UserId)
-	msg := fmt.Sprintf("Timer '%s' created", t.Name)
-	SendTelegramMsg(tgid, msg)
+	t.notify(NotifyCreated, "", fmt.Sprintf("Timer '%s' created", t.Name))
+
+	return nil
+}
+
+// TimerChanges holds the settings to modify. Nil fields are left as is.
+type TimerChanges struct {
+	Name            *string   `json:"name"`
+	Slug            *string   `json:"slug"`
+	Interval        *int64    `json:"interval"`
+	Grace           *int64    `json:"grace"`
+	Schedule        *string   `json:"schedule"`
+	Timezone        *string   `json:"timezone"`
+	MaxRuntime      *int64    `json:"max_runtime"`
+	Reminder        *int64    `json:"reminder"`
+	ReminderMax     *int64    `json:"reminder_max"`
+	ReminderBackoff *bool     `json:"reminder_backoff"`
+	Channels        *[]string `json:"channels"`
+}
+
+// apply sets the changed settings to t and describes the differences.
+func (c *TimerChanges) apply(t *Timer) []string {
+	diff := []string{}
+	if c.Name != nil && *c.Name != t.Name {
+		diff = append(diff, fmt.Sprintf("name '%s' -> '%s'", t.Name, *c.Name))
+		t.Name = *c.Name
+	}
+	if c.Slug != nil && *c.Slug != t.Slug {
+		// An empty slug is generated from the name
+		slug := *c.Slug
+		if slug == "" {
+			slug = t.Database.uniqueSlug(t.UserId, t.Id, slugify(t.Name))
+		}
+		diff = append(diff, fmt.Sprintf("slug '%s' -> '%s'", t.Slug, slug))
+		t.Slug = slug
+	}
+	ints := []struct {
+		name string
+		new  *int64
+		old  *int64
+	}{
+		{"interval", c.Interval, &t.Interval},
+		{"grace", c.Grace, &t.Grace},
+		{"max_runtime", c.MaxRuntime, &t.MaxRuntime},
+		{"reminder", c.Reminder, &t.Reminder},
+		{"reminder_max", c.ReminderMax, &t.ReminderMax},
+	}
+	for _, f := range ints {
+		if f.new != nil && *f.new != *f.old {
+			diff = append(diff, fmt.Sprintf("%s %d -> %d", f.name, *f.old, *f.new))
+			*f.old = *f.new
+		}
+	}
+	if c.Schedule != nil && *c.Schedule != t.Schedule {
+		diff = append(diff, fmt.Sprintf("schedule '%s' -> '%s'", t.Schedule, *c.Schedule))
+		t.Schedule = *c.Schedule
+	}
+	if c.Timezone != nil && *c.Timezone != t.Timezone {
+		diff = append(diff, fmt.Sprintf("timezone '%s' -> '%s'", t.Timezone, *c.Timezone))
+		t.Timezone = *c.Timezone
+	}
+	if c.ReminderBackoff != nil && *c.ReminderBackoff != t.ReminderBackoff {
+		diff = append(diff, fmt.Sprintf("reminder_backoff %t -> %t", t.ReminderBackoff, *c.ReminderBackoff))
+		t.ReminderBackoff = *c.ReminderBackoff
+	}
+	if c.Channels != nil && strings.Join(*c.Channels, ",") != strings.Join(t.Channels, ",") {
+		diff = append(diff, fmt.Sprintf("channels [%s] -> [%s]", strings.Join(t.Channels, ", "), strings.Join(*c.Channels, ", ")))
+		t.Channels = append([]string{}, *c.Channels...)
+	}
+	return diff
+}
+
+// Update modifies the timer settings. The expiry of a running timer is
+// recomputed from its last kick.
+func (t *Timer) Update(c *TimerChanges) error {
+	u := *t
+	diff := c.apply(&u)
+	if err := u.Validate(); err != nil {
+		return err
+	}
+	if len(diff) == 0 {
+		return nil
+	}
+
+	if u.State == "running" || u.State == "late" {
+		from := time.Now()
+		if u.Kicked > 0 {
+			from = time.Unix(u.Kicked, 0)
+		}
+		u.Expiry = u.nextExpiry(from)
+		if u.State == "late" && u.Expiry >= time.Now().Unix() {
+			u.State = "running"
+		}
+	}
+
+	res, err := t.Database.db.Exec(
+		`UPDATE Timer
+		SET name=?, slug=?, interval=?, grace=?, schedule=?, timezone=?, max_runtime=?,
+			reminder=?, reminder_max=?, reminder_backoff=?, channels=?, expiry=?, state=?
+		WHERE id=? AND user_id=? AND state=? AND expiry=? AND kicked=?`,
+		u.Name,
+		u.Slug,
+		u.Interval,
+		u.Grace,
+		u.Schedule,
+		u.Timezone,
+		u.MaxRuntime,
+		u.Reminder,
+		u.ReminderMax,
+		u.ReminderBackoff,
+		u.channelsJSON(),
+		u.Expiry,
+		u.State,
+		t.Id,
+		t.UserId,
+		t.State,
+		t.Expiry,
+		t.Kicked,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Kicked, started or expired meanwhile
+		return errors.New("Timer state changed, try again")
+	}
+
+	log.Println("Timer.Update", t, diff)
+
+	msg := fmt.Sprintf("Timer '%s' modified: %s", t.Name, strings.Join(diff, ", "))
+	from := t.State
+	*t = u
+	t.notify(NotifyModified, from, msg)
 
 	return nil
 }
@@ -211,70 +683,435 @@ func (t *Timer) Delete() (err error) {
 		return sql.ErrNoRows
 	}
 
+	// Leaked kick URLs of a deleted timer must not work for a new one
+	if _, err := t.Database.db.Exec(`DELETE FROM Token WHERE timer_id=?`, t.Id); err != nil {
+		panic(err)
+	}
+
 	log.Println("Timer.Delete", t)
 
-	tgid, _ := t.Database.GetUserTelegramIdById(t.UserId)
-	msg := fmt.Sprintf("Timer '%s' deleted", t.Name)
-	SendTelegramMsg(tgid, msg)
+	from := t.State
+	t.State = "deleted"
+	t.notify(NotifyDeleted, from, fmt.Sprintf("Timer '%s' deleted", t.Name))
 
 	return nil
 }
 
 func (t *Timer) Kick() error {
+	now := time.Now()
+	expiry := t.nextExpiry(now)
+
+	// Update only if the previous state read is still current, so that a
+	// concurrent expiry or kick is not missed. A read-write transaction
+	// would fail with "database is locked" under concurrent kicks, as
+	// SQLite cannot upgrade two readers to writers.
+	var state string
+	var prevExpiry, kicked, started int64
+	for {
+		err := t.Database.db.QueryRow(
+			`SELECT state, expiry, kicked, started FROM Timer WHERE id=? AND user_id=?`,
+			t.Id,
+			t.UserId,
+		).Scan(&state, &prevExpiry, &kicked, &started)
+		if err != nil {
+			return err
+		}
+
+		res, err := t.Database.db.Exec(
+			`UPDATE Timer
+			SET expiry=?, state='running', started=0, kicked=?, reminders=0, acked=0, acked_by='', next_reminder=0
+			WHERE id=? AND user_id=? AND state=? AND expiry=? AND kicked=? AND started=?`,
+			expiry,
+			now.Unix(),
+			t.Id,
+			t.UserId,
+			state,
+			prevExpiry,
+			kicked,
+			started,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			break
+		}
+	}
+
+	t.State = "running"
+	t.Expiry = expiry
+	t.Kicked = now.Unix()
+	t.Started = 0
+	t.Acked = 0
+	t.AckedBy = ""
+
+	log.Println("Timer.Kick", t)
+	countKick()
+
+	if state == "started" {
+		t.record("run", state, now.Unix()-started, NoExitCode)
+	}
+
+	if state == "expired" || state == "failed" {
+		t.notify(NotifyRecovered, state, recoveryMsg(t.Name, now, prevExpiry, kicked))
+	} else if state != "running" {
+		t.notify(NotifyKicked, state, "")
+	} else {
+		// No notification, but every kick is logged
+		t.record(NotifyKicked, state, 0, NoExitCode)
+	}
+
+	return nil
+}
+
+// recoveryMsg describes how long the timer was down. Expired and failed
+// timers are both considered down since their expiry.
+func recoveryMsg(name string, now time.Time, downSince, lastKicked int64) string {
+	downtime := time.Duration(now.Unix()-downSince) * time.Second
+	if downtime < 0 {
+		downtime = 0
+	}
+
+	msg := fmt.Sprintf("Timer '%s' recovered after %s of downtime", name, downtime)
+	if lastKicked > 0 {
+		last := time.Unix(lastKicked, 0).UTC().Format("2006-01-02 15:04:05 MST")
+		msg += fmt.Sprintf(" (last success %s)", last)
+	}
+	return msg
+}
+
+// Exit code given to Fail when the job did not report one
+const NoExitCode = -1
+
+// Fail marks the timer failed right away, without waiting for the expiry.
+// The failed timer is not processed for expiry until it is kicked again.
+func (t *Timer) Fail(exitCode int) error {
 	now := time.Now().Unix()
-	t.Database.db.Exec(
-		`UPDATE Timer 
-		SET expiry=interval+?, state="running"
+	_, err := t.Database.db.Exec(
+		`UPDATE Timer
+		SET expiry=?, state='failed', started=0, reminders=0, acked=0, acked_by='', next_reminder=?
 		WHERE id=? and user_id=?`,
 		now,
+		t.firstReminder(now),
 		t.Id,
 		t.UserId,
 	)
+	if err != nil {
+		return err
+	}
 
-	log.Println("Timer.Kick", t)
+	from := t.State
+	t.State = "failed"
+	t.Expiry = now
+	t.Started = 0
+	t.Acked = 0
+	t.AckedBy = ""
 
-	if t.State == "expired" {
-		tgid, _ := t.Database.GetUserTelegramIdById(t.UserId)
-		msg := fmt.Sprintf("Expired timer '%s' kicked", t.Name)
-		SendTelegramMsg(tgid, msg)
+	log.Println("Timer.Fail", t, exitCode)
+
+	msg := fmt.Sprintf("Timer '%s' failed", t.Name)
+	if exitCode != NoExitCode {
+		msg = fmt.Sprintf("Timer '%s' failed with exit code %d", t.Name, exitCode)
 	}
+	t.notifyExit(NotifyFailed, from, msg, exitCode)
+
+	return nil
+}
+
+// Start marks the beginning of a job run. The following kick finishes the
+// run, which must happen within MaxRuntime (or the normal expiry if unset).
+func (t *Timer) Start() error {
+	now := time.Now()
+	expiry := t.nextExpiry(now)
+	if t.MaxRuntime > 0 {
+		expiry = now.Unix() + t.MaxRuntime
+	}
+
+	_, err := t.Database.db.Exec(
+		`UPDATE Timer
+		SET expiry=?, state='started', started=?, reminders=0, acked=0, acked_by='', next_reminder=0
+		WHERE id=? and user_id=?`,
+		expiry,
+		now.Unix(),
+		t.Id,
+		t.UserId,
+	)
+	if err != nil {
+		return err
+	}
+
+	from := t.State
+	t.State = "started"
+	t.Expiry = expiry
+	t.Started = now.Unix()
+
+	log.Println("Timer.Start", t)
+
+	msg := ""
+	if from == "expired" {
+		msg = fmt.Sprintf("Expired timer '%s' started", t.Name)
+	}
+	t.notify(NotifyStarted, from, msg)
+
+	return nil
+}
+
+// Pause stops the timer from expiring until it is resumed or kicked.
+func (t *Timer) Pause() error {
+	_, err := t.Database.db.Exec(
+		`UPDATE Timer
+		SET state='paused', started=0, reminders=0, acked=0, acked_by='', next_reminder=0
+		WHERE id=? and user_id=?`,
+		t.Id,
+		t.UserId,
+	)
+	if err != nil {
+		return err
+	}
+	from := t.State
+	t.State = "paused"
+
+	log.Println("Timer.Pause", t)
+
+	t.notify(NotifyPaused, from, fmt.Sprintf("Timer '%s' paused", t.Name))
+
+	return nil
+}
+
+// Resume restarts a paused timer as if it was kicked now.
+func (t *Timer) Resume() error {
+	expiry := t.nextExpiry(time.Now())
+	res, err := t.Database.db.Exec(
+		`UPDATE Timer
+		SET state='running', expiry=?
+		WHERE id=? and user_id=? AND state='paused'`,
+		expiry,
+		t.Id,
+		t.UserId,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Timer is not paused")
+	}
+	t.State = "running"
+	t.Expiry = expiry
+
+	log.Println("Timer.Resume", t)
+
+	t.notify(NotifyResumed, "paused", fmt.Sprintf("Timer '%s' resumed", t.Name))
 
 	return nil
 }
 
 func (t *Timer) Expire() {
 	log.Println("Timer.Expire", t)
-	if _, err := t.Database.db.Exec(`UPDATE Timer SET state="expired" WHERE id=? AND expiry=?`, t.Id, t.Expiry); err != nil {
+	res, err := t.Database.db.Exec(
+		`UPDATE Timer SET state='expired', reminders=0, acked=0, acked_by='', next_reminder=? WHERE id=? AND expiry=? AND state=?`,
+		t.firstReminder(time.Now().Unix()),
+		t.Id,
+		t.Expiry,
+		t.State,
+	)
+	if err != nil {
 		log.Fatal(err)
 	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Kicked or paused meanwhile
+		return
+	}
+
+	countExpire()
 
-	tgid, _ := t.Database.GetUserTelegramIdById(t.UserId)
 	msg := fmt.Sprintf("Timer '%s' has expired", t.Name)
-	SendTelegramMsg(tgid, msg)
+	if t.State == "started" {
+		msg = fmt.Sprintf("Timer '%s' started but did not finish in time", t.Name)
+	}
+	from := t.State
+	t.State = "expired"
+	t.Acked = 0
+	t.AckedBy = ""
+	t.notify(NotifyExpired, from, msg)
+}
+
+// Late marks an overdue timer that is still within its grace period.
+// No message is sent; Expire takes over once the grace has passed.
+func (t *Timer) Late() {
+	log.Println("Timer.Late", t)
+	res, err := t.Database.db.Exec(`UPDATE Timer SET state='late' WHERE id=? AND expiry=? AND state='running'`, t.Id, t.Expiry)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Kicked meanwhile
+		return
+	}
+
+	t.State = "late"
+	t.notify(NotifyLate, "running", "")
 }
 
 func (p *Database) ProcessExpiredTimers() int {
-	now := time.Now().Unix()
+	start := time.Now()
+	now := start.Unix()
 	s := make([]*Timer, 0, 1000)
 
-	// Collect all expired timers
-	rows, err := p.db.Query(`SELECT id,user_id,name,expiry FROM Timer WHERE state="running" AND expiry<? LIMIT ?`, now, cap(s))
+	// Collect all overdue timers, the states match TimerIndexExpiryActive
+	rows, err := p.db.Query(`SELECT `+timerColumns+` FROM Timer WHERE state IN ('running', 'started', 'late') AND expiry<? LIMIT ?`, now, cap(s))
 	if err != nil {
 		log.Fatal(err)
 	}
 	for rows.Next() {
-		t := p.NewTimer()
-		if err := rows.Scan(&t.Id, &t.UserId, &t.Name, &t.Expiry); err != nil {
+		t, err := p.scanTimer(rows)
+		if err != nil {
 			log.Fatal(err)
 		}
 		s = append(s, t)
 	}
 	rows.Close()
 
-	// Make them expired
+	// Make them late or expired depending on the grace period. A started
+	// timer has already used its max runtime, so it expires right away.
+	n := 0
 	for _, t := range s {
-		t.Expire()
+		if p.inMaintenance(t, now) {
+			continue
+		}
+		if t.Expiry+t.effectiveGrace() < now || t.State == "started" {
+			t.Expire()
+			n++
+		} else if t.State == "running" {
+			t.Late()
+		}
+	}
+
+	observeExpiredRun(time.Since(start), len(s))
+	return n
+}
+
+// Event entries
+
+// Run is a finished job run, from a start ping to the following kick
+type Run struct {
+	Started  int64 `json:"started"`
+	Finished int64 `json:"finished"`
+	Duration int64 `json:"duration"`
+}
+
+// Event is an entry of the append-only log of the timer's kicks, runs and
+// state changes
+type Event struct {
+	Id      int64 `json:"id"`
+	TimerId int64 `json:"timerid"`
+	UserId  int64 `json:"-"`
+	// Notification type of the state change, or "run" for a finished run
+	Type  string `json:"type"`
+	From  string `json:"from"`
+	State string `json:"state"`
+	// Run duration of "run" events
+	Duration int64 `json:"duration"`
+	// Exit code of "failed" events, NoExitCode if not reported
+	ExitCode  int    `json:"exit_code"`
+	SourceIP  string `json:"source_ip"`
+	UserAgent string `json:"user_agent"`
+	Time      int64  `json:"time"`
+}
+
+// EventSource tells where the request changing the timer came from
+type EventSource struct {
+	IP        string
+	UserAgent string
+}
+
+func (p *Database) addEvent(e *Event) {
+	_, err := p.db.Exec(
+		`INSERT INTO Event (timer_id, user_id, type, from_state, state, duration, exit_code, source_ip, user_agent, ts)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.TimerId,
+		e.UserId,
+		e.Type,
+		e.From,
+		e.State,
+		e.Duration,
+		e.ExitCode,
+		e.SourceIP,
+		e.UserAgent,
+		e.Time,
+	)
+	if err != nil {
+		log.Println("WARNING: Database.addEvent", e.TimerId, e.Type, err)
+	}
+}
+
+// record adds an event of the timer in its current state.
+func (t *Timer) record(eventType, from string, duration int64, exitCode int) {
+	e := &Event{
+		TimerId:  t.Id,
+		UserId:   t.UserId,
+		Type:     eventType,
+		From:     from,
+		State:    t.State,
+		Duration: duration,
+		ExitCode: exitCode,
+		Time:     time.Now().Unix(),
+	}
+	if t.Source != nil {
+		e.SourceIP = t.Source.IP
+		e.UserAgent = t.Source.UserAgent
+	}
+	t.Database.addEvent(e)
+}
+
+// GetEvents returns the latest events of the timer older than the event
+// before (all if 0), newest first.
+func (t *Timer) GetEvents(before int64, limit int) []Event {
+	events := []Event{}
+	rows, err := t.Database.db.Query(
+		`SELECT id, type, from_state, state, duration, exit_code, source_ip, user_agent, ts FROM Event
+		WHERE timer_id=? AND (?=0 OR id<?)
+		ORDER BY id DESC LIMIT ?`,
+		t.Id,
+		before,
+		before,
+		limit,
+	)
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer rows.Close()
 
-	return len(s)
+	for rows.Next() {
+		e := Event{TimerId: t.Id, UserId: t.UserId}
+		err := rows.Scan(&e.Id, &e.Type, &e.From, &e.State, &e.Duration, &e.ExitCode, &e.SourceIP, &e.UserAgent, &e.Time)
+		if err != nil {
+			log.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// GetRuns returns the latest job runs of the timer, newest first.
+func (t *Timer) GetRuns(limit int) []Run {
+	runs := []Run{}
+	rows, err := t.Database.db.Query(
+		`SELECT duration, ts FROM Event WHERE timer_id=? AND type='run' ORDER BY id DESC LIMIT ?`,
+		t.Id,
+		limit,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Run
+		if err := rows.Scan(&r.Duration, &r.Finished); err != nil {
+			log.Fatal(err)
+		}
+		r.Started = r.Finished - r.Duration
+		runs = append(runs, r)
+	}
+	return runs
 }
@@ -0,0 +1,220 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Incidents within a digest period after which a timer is flapping
+const DigestFlapping = 3
+
+// Period of a digest sent on request before the first scheduled one
+const DefaultDigestPeriod = 24 * 3600
+
+// DigestSettings are the user's settings of the scheduled digest messages
+type DigestSettings struct {
+	// Cron schedule of the digests, no digests if empty
+	Schedule string `json:"schedule"`
+	Timezone string `json:"timezone"`
+	// Time of the next and the previous digest, set by the service
+	Next int64 `json:"next"`
+	Last int64 `json:"last"`
+}
+
+// nextDigest returns the time of the digest following now, or 0 if the
+// schedule is empty or invalid.
+func (s *DigestSettings) nextDigest(now time.Time) int64 {
+	if s.Schedule == "" {
+		return 0
+	}
+	sched, loc, err := parseSchedule(s.Schedule, s.Timezone)
+	if err != nil {
+		log.Println("WARNING: DigestSettings.nextDigest", s, err)
+		return 0
+	}
+	return sched.Next(now.In(loc)).Unix()
+}
+
+func (p *Database) GetDigestSettings(userid int64) (*DigestSettings, error) {
+	s := &DigestSettings{}
+	err := p.db.QueryRow(
+		`SELECT digest_schedule, digest_timezone, next_digest, last_digest FROM User WHERE id=?`,
+		userid,
+	).Scan(&s.Schedule, &s.Timezone, &s.Next, &s.Last)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetDigestSchedule validates and stores the digest schedule of the user.
+// The next digest covers the time from now on.
+func (p *Database) SetDigestSchedule(userid int64, schedule, timezone string) (*DigestSettings, error) {
+	if schedule == "" && timezone != "" {
+		return nil, errors.New("Timezone requires a schedule")
+	}
+	if schedule != "" {
+		if _, _, err := parseSchedule(schedule, timezone); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	s := &DigestSettings{Schedule: schedule, Timezone: timezone, Last: now.Unix()}
+	s.Next = s.nextDigest(now)
+	res, err := p.db.Exec(
+		`UPDATE User SET digest_schedule=?, digest_timezone=?, next_digest=?, last_digest=? WHERE id=?`,
+		s.Schedule,
+		s.Timezone,
+		s.Next,
+		s.Last,
+		userid,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, errors.New("User not found")
+	}
+
+	log.Println("Database.SetDigestSchedule", userid, s)
+	return s, nil
+}
+
+// Digest summarizes the user's timers from from to to: the timers that
+// expired or failed and for how long, the flapping ones and the ones never
+// kicked.
+func (p *Database) Digest(userid, from, to int64, loc *time.Location) string {
+	var expired, flapping, never []string
+	for _, t := range p.GetTimers(userid) {
+		if t.State == "new" {
+			never = append(never, "- "+t.Name)
+			continue
+		}
+		r := t.Report(from, to)
+		if r.Incidents == 0 {
+			continue
+		}
+		incidents := "incidents"
+		if r.Incidents == 1 {
+			incidents = "incident"
+		}
+		line := fmt.Sprintf("- %s: %d %s, down for %s", t.Name, r.Incidents, incidents, time.Duration(r.Downtime)*time.Second)
+		if r.Incidents >= DigestFlapping {
+			flapping = append(flapping, line)
+		} else {
+			expired = append(expired, line)
+		}
+	}
+
+	const layout = "2006-01-02 15:04 MST"
+	lines := []string{fmt.Sprintf("Digest %s - %s", time.Unix(from, 0).In(loc).Format(layout), time.Unix(to, 0).In(loc).Format(layout))}
+	for _, section := range []struct {
+		title string
+		lines []string
+	}{
+		{"Expired or failed:", expired},
+		{"Flapping:", flapping},
+		{"Never kicked:", never},
+	} {
+		if len(section.lines) > 0 {
+			lines = append(lines, section.title)
+			lines = append(lines, section.lines...)
+		}
+	}
+	if len(lines) == 1 {
+		lines = append(lines, "All timers OK")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// location returns the timezone of the digests, UTC if none.
+func (s *DigestSettings) location() *time.Location {
+	if loc, err := time.LoadLocation(s.Timezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// digestChannel returns the name of the channel sending to the user's own
+// Telegram chat, or "" if there is none.
+func (p *Database) digestChannel(userid int64) string {
+	for _, c := range p.GetChannels(userid) {
+		if c.Kind == "telegram" && p.isOwnTelegramChat(c) {
+			return c.Name
+		}
+	}
+	return ""
+}
+
+// sendDigest queues the digest of the user to the user's own Telegram chat
+// unless another digest was sent meanwhile. Failed deliveries are retried
+// through the outbox.
+func (p *Database) sendDigest(userid int64, s *DigestSettings) {
+	now := time.Now()
+	res, err := p.db.Exec(
+		`UPDATE User SET next_digest=?, last_digest=? WHERE id=? AND next_digest=?`,
+		s.nextDigest(now),
+		now.Unix(),
+		userid,
+		s.Next,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Rescheduled meanwhile
+		return
+	}
+
+	channel := p.digestChannel(userid)
+	if channel == "" {
+		log.Println("WARNING: Database.sendDigest, no Telegram channel to the own chat", userid)
+		return
+	}
+	p.Notify(&Notification{
+		Type:     NotifyDigest,
+		UserId:   userid,
+		Time:     now.Unix(),
+		Text:     p.Digest(userid, s.Last, now.Unix(), s.location()),
+		Channels: []string{channel},
+	})
+}
+
+// ProcessDigests queues the due digests.
+func (p *Database) ProcessDigests() int {
+	now := time.Now().Unix()
+	type due struct {
+		userid int64
+		s      DigestSettings
+	}
+	ds := make([]due, 0, 1000)
+
+	rows, err := p.db.Query(
+		`SELECT id, digest_schedule, digest_timezone, next_digest, last_digest FROM User
+		WHERE digest_schedule<>'' AND next_digest>0 AND next_digest<=?
+		LIMIT ?`,
+		now,
+		cap(ds),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.userid, &d.s.Schedule, &d.s.Timezone, &d.s.Next, &d.s.Last); err != nil {
+			log.Fatal(err)
+		}
+		ds = append(ds, d)
+	}
+	rows.Close()
+
+	for _, d := range ds {
+		p.sendDigest(d.userid, &d.s)
+	}
+
+	return len(ds)
+}
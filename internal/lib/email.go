@@ -0,0 +1,238 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// SmtpConfig is the mail server used by the "email" channels
+type SmtpConfig struct {
+	Host     string
+	Port     int
+	StartTLS bool
+	Username string
+	Password string
+	From     string
+	// Templates of the mail subject and body, executed with the notification
+	Subject string
+	Body    string
+}
+
+const defaultEmailSubject = `[go-watchdog] Timer '{{.Name}}' {{.Type}}`
+const defaultEmailBody = `{{.Text}}
+
+Timer:  {{.Name}} ({{.TimerId}})
+State:  {{.From}} -> {{.State}}
+Expiry: {{.ExpiryUTC}}
+Time:   {{.TimeUTC}}
+`
+
+var Smtp *SmtpConfig = nil
+
+// SmtpConfigFromEnv reads the SMTP settings from the environment. It
+// returns nil if SMTP_HOST is not set.
+func SmtpConfigFromEnv() *SmtpConfig {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil
+	}
+
+	cfg := &SmtpConfig{
+		Host:     host,
+		Port:     587,
+		StartTLS: true,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+		Subject:  os.Getenv("SMTP_SUBJECT"),
+		Body:     os.Getenv("SMTP_BODY"),
+	}
+	if port, err := strconv.Atoi(os.Getenv("SMTP_PORT")); err == nil {
+		cfg.Port = port
+	}
+	if starttls, err := strconv.ParseBool(os.Getenv("SMTP_STARTTLS")); err == nil {
+		cfg.StartTLS = starttls
+	}
+	return cfg
+}
+
+func InitEmail(cfg *SmtpConfig) {
+	if cfg == nil {
+		log.Println("WARNING: Email initialization skipped")
+		Smtp = nil
+		return
+	}
+
+	if cfg.From == "" {
+		cfg.From = "go-watchdog@" + cfg.Host
+	}
+	if cfg.Subject == "" {
+		cfg.Subject = defaultEmailSubject
+	}
+	if cfg.Body == "" {
+		cfg.Body = defaultEmailBody
+	}
+	for _, tmpl := range []string{cfg.Subject, cfg.Body} {
+		if _, err := template.New("email").Parse(tmpl); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	log.Println("Email server:", cfg.Host, cfg.Port)
+	Smtp = cfg
+}
+
+// Config of the "email" channel kind
+type emailConfig struct {
+	To string `json:"to"`
+	// Notification types to mail, expiries and recoveries by default
+	Events []string `json:"events"`
+}
+
+// emailNotifier mails the notifications to an address
+type emailNotifier struct {
+	config emailConfig
+	to     *mail.Address
+	smtp   *SmtpConfig
+}
+
+func newEmailNotifier(db *Database, c *Channel) (Notifier, error) {
+	if Smtp == nil {
+		return nil, errors.New("Email is not configured")
+	}
+
+	var config emailConfig
+	if err := json.Unmarshal(c.Config, &config); err != nil {
+		return nil, fmt.Errorf("Invalid email config: %s", err)
+	}
+	to, err := mail.ParseAddress(config.To)
+	if err != nil {
+		return nil, errors.New("Invalid email address")
+	}
+	if len(config.Events) == 0 {
+		config.Events = []string{NotifyExpired, NotifyFailed, NotifyReminder, NotifyRecovered}
+	}
+
+	return &emailNotifier{config: config, to: to, smtp: Smtp}, nil
+}
+
+// Data given to the subject and body templates
+type emailData struct {
+	*Notification
+	TimeUTC   string
+	ExpiryUTC string
+}
+
+func (n *emailNotifier) render(tmpl string, data *emailData) (string, error) {
+	t, err := template.New("email").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Accepts skips the events not listed in the config.
+func (n *emailNotifier) Accepts(m *Notification) bool {
+	return contains(n.config.Events, m.Type)
+}
+
+func (n *emailNotifier) Notify(m *Notification) error {
+	if !n.Accepts(m) {
+		return nil
+	}
+
+	const layout = "2006-01-02 15:04:05 MST"
+	data := &emailData{
+		Notification: m,
+		TimeUTC:      time.Unix(m.Time, 0).UTC().Format(layout),
+		ExpiryUTC:    time.Unix(m.Expiry, 0).UTC().Format(layout),
+	}
+	subject, err := n.render(n.smtp.Subject, data)
+	if err != nil {
+		return err
+	}
+	body, err := n.render(n.smtp.Body, data)
+	if err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.smtp.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", n.to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	return n.send(msg.Bytes())
+}
+
+func (n *emailNotifier) send(msg []byte) error {
+	cfg := n.smtp
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	c, err := smtp.NewClient(conn, cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if cfg.StartTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: cfg.Host}); err != nil {
+			return err
+		}
+	}
+	if cfg.Username != "" {
+		auth := smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(cfg.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(n.to.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func init() {
+	RegisterNotifier("email", newEmailNotifier)
+}
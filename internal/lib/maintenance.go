@@ -0,0 +1,193 @@
+package lib
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// Maintenance is a time range during which the timers do not expire. It is
+// either a one-off window from Start to End, or a recurring window of
+// Duration seconds starting at each time of the cron Schedule.
+type Maintenance struct {
+	Id       int64  `json:"id"`
+	UserId   int64  `json:"-"`
+	Name     string `json:"name"`
+	Start    int64  `json:"start"`
+	End      int64  `json:"end"`
+	Schedule string `json:"schedule"`
+	Timezone string `json:"timezone"`
+	Duration int64  `json:"duration"`
+	// Timers covered by the window, all of the user's timers if empty
+	Timers []int64 `json:"timers"`
+
+	// Other
+	Database *Database `json:"-"`
+}
+
+func (p *Database) NewMaintenance() *Maintenance {
+	return &Maintenance{
+		Timers:   []int64{},
+		Database: p,
+	}
+}
+
+// Validate checks the window settings given by the user.
+func (m *Maintenance) Validate() error {
+	if m.Schedule == "" {
+		if m.Timezone != "" || m.Duration != 0 {
+			return errors.New("Timezone and duration require a schedule")
+		}
+		if m.Start <= 0 || m.End <= m.Start {
+			return errors.New("Invalid start or end")
+		}
+	} else {
+		if m.Start != 0 || m.End != 0 {
+			return errors.New("Use either start and end or schedule")
+		}
+		if m.Duration <= 0 {
+			return errors.New("Invalid duration")
+		}
+		if _, _, err := parseSchedule(m.Schedule, m.Timezone); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range m.Timers {
+		if m.Database.GetTimer(id, m.UserId) == nil {
+			return errors.New("Timer not found")
+		}
+	}
+	return nil
+}
+
+// Active tells whether the window covers the given time.
+func (m *Maintenance) Active(now int64) bool {
+	if m.Schedule == "" {
+		return m.Start <= now && now < m.End
+	}
+
+	sched, loc, err := parseSchedule(m.Schedule, m.Timezone)
+	if err != nil {
+		log.Println("WARNING: Maintenance.Active", m, err)
+		return false
+	}
+
+	// A window is active if one has started within the last Duration
+	start := sched.Next(time.Unix(now-m.Duration, 0).In(loc))
+	return start.Unix() <= now
+}
+
+func (m *Maintenance) Create() error {
+	tx, err := m.Database.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`INSERT INTO Maintenance (user_id, name, start, end, schedule, timezone, duration)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		m.UserId,
+		m.Name,
+		m.Start,
+		m.End,
+		m.Schedule,
+		m.Timezone,
+		m.Duration,
+	)
+	if err != nil {
+		return err
+	}
+
+	m.Id, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range m.Timers {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO MaintenanceTimer (maintenance_id, timer_id) VALUES (?, ?)`, m.Id, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Println("Maintenance.Create", m)
+	return tx.Commit()
+}
+
+func (m *Maintenance) Delete() error {
+	res, err := m.Database.db.Exec(`DELETE FROM Maintenance WHERE id=? AND user_id=?`, m.Id, m.UserId)
+	if err != nil {
+		return err
+	}
+
+	numDeleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if numDeleted != 1 {
+		return errors.New("Maintenance not found")
+	}
+
+	_, err = m.Database.db.Exec(`DELETE FROM MaintenanceTimer WHERE maintenance_id=?`, m.Id)
+
+	log.Println("Maintenance.Delete", m)
+	return err
+}
+
+// GetMaintenances returns the user's windows. If timerid is not 0, only the
+// windows covering that timer are returned.
+func (p *Database) GetMaintenances(userid, timerid int64) []*Maintenance {
+	ms := []*Maintenance{}
+	rows, err := p.db.Query(
+		`SELECT id, name, start, end, schedule, timezone, duration FROM Maintenance m
+		WHERE user_id=? AND (
+			?=0
+			OR NOT EXISTS (SELECT 1 FROM MaintenanceTimer WHERE maintenance_id=m.id)
+			OR EXISTS (SELECT 1 FROM MaintenanceTimer WHERE maintenance_id=m.id AND timer_id=?)
+		)`,
+		userid,
+		timerid,
+		timerid,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for rows.Next() {
+		m := p.NewMaintenance()
+		m.UserId = userid
+		if err := rows.Scan(&m.Id, &m.Name, &m.Start, &m.End, &m.Schedule, &m.Timezone, &m.Duration); err != nil {
+			log.Fatal(err)
+		}
+		ms = append(ms, m)
+	}
+	rows.Close()
+
+	for _, m := range ms {
+		rows, err := p.db.Query(`SELECT timer_id FROM MaintenanceTimer WHERE maintenance_id=? ORDER BY timer_id`, m.Id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				log.Fatal(err)
+			}
+			m.Timers = append(m.Timers, id)
+		}
+		rows.Close()
+	}
+
+	return ms
+}
+
+// inMaintenance tells whether any window covers the timer at the given time.
+func (p *Database) inMaintenance(t *Timer, now int64) bool {
+	for _, m := range p.GetMaintenances(t.UserId, t.Id) {
+		if m.Active(now) {
+			return true
+		}
+	}
+	return false
+}
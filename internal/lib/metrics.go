@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Bearer token required from the /metrics scraper, no authentication and no
+// per-timer series if empty
+var MetricsToken string
+
+// Counters of the service since it was started
+var metrics = struct {
+	sync.Mutex
+	kicks   int64
+	expires int64
+	// Deliveries by channel kind and result
+	notifications map[[2]string]int64
+	// ProcessExpiredTimers runs
+	expiredRuns      int64
+	expiredSeconds   float64
+	expiredTimers    int64
+	lastRunSeconds   float64
+	lastRunBatchSize int
+}{
+	notifications: map[[2]string]int64{},
+}
+
+func countKick() {
+	metrics.Lock()
+	metrics.kicks++
+	metrics.Unlock()
+}
+
+func countExpire() {
+	metrics.Lock()
+	metrics.expires++
+	metrics.Unlock()
+}
+
+func countNotification(kind string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metrics.Lock()
+	metrics.notifications[[2]string{kind, result}]++
+	metrics.Unlock()
+}
+
+func observeExpiredRun(d time.Duration, batchSize int) {
+	metrics.Lock()
+	metrics.expiredRuns++
+	metrics.expiredSeconds += d.Seconds()
+	metrics.expiredTimers += int64(batchSize)
+	metrics.lastRunSeconds = d.Seconds()
+	metrics.lastRunBatchSize = batchSize
+	metrics.Unlock()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricHeader writes the HELP and TYPE lines of a metric.
+func metricHeader(w io.Writer, name, mtype, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, mtype)
+}
+
+// WriteMetrics writes the metrics in the Prometheus text format. The
+// per-timer series, which show the users' timer names, are included only
+// if timers is set.
+func (p *Database) WriteMetrics(w io.Writer, timers bool) {
+	now := time.Now().Unix()
+
+	// Timers by state, including the states without timers
+	counts := map[string]int64{}
+	for _, state := range []string{"new", "running", "started", "late", "expired", "failed", "paused"} {
+		counts[state] = 0
+	}
+	rows, err := p.db.Query(`SELECT state, COUNT(*) FROM Timer GROUP BY state`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for rows.Next() {
+		var state string
+		var n int64
+		if err := rows.Scan(&state, &n); err != nil {
+			log.Fatal(err)
+		}
+		counts[state] = n
+	}
+	rows.Close()
+
+	states := make([]string, 0, len(counts))
+	for state := range counts {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+
+	metricHeader(w, "watchdog_timers", "gauge", "Number of timers by state.")
+	for _, state := range states {
+		fmt.Fprintf(w, "watchdog_timers{state=\"%s\"} %d\n", labelEscaper.Replace(state), counts[state])
+	}
+
+	if timers {
+		p.writeTimerMetrics(w, now)
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	metricHeader(w, "watchdog_kicks_total", "counter", "Number of timer kicks.")
+	fmt.Fprintf(w, "watchdog_kicks_total %d\n", metrics.kicks)
+	metricHeader(w, "watchdog_expires_total", "counter", "Number of timer expiries.")
+	fmt.Fprintf(w, "watchdog_expires_total %d\n", metrics.expires)
+
+	keys := make([][2]string, 0, len(metrics.notifications))
+	for k := range metrics.notifications {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+	})
+	metricHeader(w, "watchdog_notifications_total", "counter", "Number of notification deliveries by channel kind and result.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "watchdog_notifications_total{kind=\"%s\",result=\"%s\"} %d\n",
+			labelEscaper.Replace(k[0]), k[1], metrics.notifications[k])
+	}
+
+	metricHeader(w, "watchdog_process_expired_duration_seconds", "summary", "Duration of the expired timer processing runs.")
+	fmt.Fprintf(w, "watchdog_process_expired_duration_seconds_sum %g\n", metrics.expiredSeconds)
+	fmt.Fprintf(w, "watchdog_process_expired_duration_seconds_count %d\n", metrics.expiredRuns)
+	metricHeader(w, "watchdog_process_expired_timers_total", "counter", "Number of overdue timers processed.")
+	fmt.Fprintf(w, "watchdog_process_expired_timers_total %d\n", metrics.expiredTimers)
+	metricHeader(w, "watchdog_process_expired_last_duration_seconds", "gauge", "Duration of the last expired timer processing run.")
+	fmt.Fprintf(w, "watchdog_process_expired_last_duration_seconds %g\n", metrics.lastRunSeconds)
+	metricHeader(w, "watchdog_process_expired_last_batch_size", "gauge", "Number of overdue timers processed by the last run.")
+	fmt.Fprintf(w, "watchdog_process_expired_last_batch_size %d\n", metrics.lastRunBatchSize)
+}
+
+// writeTimerMetrics writes the per-timer series.
+func (p *Database) writeTimerMetrics(w io.Writer, now int64) {
+	metricHeader(w, "watchdog_timer_expiry_seconds", "gauge", "Seconds until the timer expires, negative when overdue.")
+	rows, err := p.db.Query(
+		`SELECT id, user_id, name, state, expiry FROM Timer
+		WHERE state IN ('running', 'started', 'late', 'expired', 'failed')
+		ORDER BY id`,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for rows.Next() {
+		var id, userid, expiry int64
+		var name, state string
+		if err := rows.Scan(&id, &userid, &name, &state, &expiry); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(w, "watchdog_timer_expiry_seconds{timerid=\"%d\",user=\"%d\",name=\"%s\",state=\"%s\"} %d\n",
+			id, userid, labelEscaper.Replace(name), state, expiry-now)
+	}
+	rows.Close()
+}
+
+// handleMetrics serves the metrics to Prometheus.
+func handleMetrics(db *Database) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if MetricsToken != "" {
+			auth := c.Request().Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+MetricsToken)) != 1 {
+				return c.String(http.StatusUnauthorized, "Unauthorized\n")
+			}
+		}
+
+		// Timer names are not shown without authentication
+		var buf strings.Builder
+		db.WriteMetrics(&buf, MetricsToken != "")
+		return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(buf.String()))
+	}
+}
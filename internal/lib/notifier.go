@@ -0,0 +1,313 @@
+package lib
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Notification types
+const (
+	NotifyCreated   = "created"
+	NotifyModified  = "modified"
+	NotifyDeleted   = "deleted"
+	NotifyStarted   = "started"
+	NotifyKicked    = "kicked"
+	NotifyLate      = "late"
+	NotifyExpired   = "expired"
+	NotifyFailed    = "failed"
+	NotifyReminder  = "reminder"
+	NotifyRecovered = "recovered"
+	NotifyPaused    = "paused"
+	NotifyResumed   = "resumed"
+	NotifyAcked     = "acked"
+	NotifySnoozed   = "snoozed"
+	// Scheduled summary of the user's timers, not a timer event
+	NotifyDigest = "digest"
+)
+
+// Notification is a timer event sent to the user's channels
+type Notification struct {
+	Type    string `json:"type"`
+	TimerId int64  `json:"timerid"`
+	UserId  int64  `json:"-"`
+	Name    string `json:"name"`
+	// State transition, From is empty for a created timer
+	From   string `json:"from"`
+	State  string `json:"state"`
+	Expiry int64  `json:"expiry"`
+	Time   int64  `json:"time"`
+	// Human readable message, empty for state changes that are not
+	// worth a chat message
+	Text string `json:"text"`
+
+	// Channel names to notify, all of the user's channels if empty
+	Channels []string `json:"-"`
+}
+
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+// notificationFilter is implemented by the notifiers that send only some
+// of the notifications. The others are not queued at all.
+type notificationFilter interface {
+	Accepts(n *Notification) bool
+}
+
+// accepts tells whether the channel sends the notification. Channels with
+// an invalid config accept all, so that the error shows in the outbox.
+func (c *Channel) accepts(n *Notification) bool {
+	notifier, err := c.Notifier()
+	if err != nil {
+		return true
+	}
+	f, ok := notifier.(notificationFilter)
+	return !ok || f.Accepts(n)
+}
+
+// NotifierFactory creates the notifier of a channel, validating its config
+type NotifierFactory func(db *Database, c *Channel) (Notifier, error)
+
+var notifierKinds = map[string]NotifierFactory{}
+
+// RegisterNotifier makes a channel kind available.
+func RegisterNotifier(kind string, factory NotifierFactory) {
+	notifierKinds[kind] = factory
+}
+
+// Channel is a named notification target of a user
+type Channel struct {
+	Id     int64  `json:"id"`
+	UserId int64  `json:"-"`
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	// Kind specific settings
+	Config json.RawMessage `json:"config"`
+
+	// Other
+	Database *Database `json:"-"`
+}
+
+// Channel created for new users, notifying the user's own Telegram chat
+const DefaultChannel = "telegram"
+
+func (p *Database) NewChannel() *Channel {
+	return &Channel{
+		Config:   json.RawMessage("{}"),
+		Database: p,
+	}
+}
+
+// Notifier returns the notifier of the channel.
+func (c *Channel) Notifier() (Notifier, error) {
+	factory, ok := notifierKinds[c.Kind]
+	if !ok {
+		return nil, fmt.Errorf("Unknown channel kind '%s'", c.Kind)
+	}
+	return factory(c.Database, c)
+}
+
+// Validate checks the channel settings given by the user.
+func (c *Channel) Validate() error {
+	if c.Name == "" {
+		return errors.New("Channel name is required")
+	}
+	if len(c.Config) == 0 {
+		c.Config = json.RawMessage("{}")
+	}
+	if !json.Valid(c.Config) {
+		return errors.New("Invalid channel config")
+	}
+	_, err := c.Notifier()
+	return err
+}
+
+func (c *Channel) Create() error {
+	res, err := c.Database.db.Exec(
+		`INSERT INTO Channel (user_id, name, kind, config) VALUES (?, ?, ?, ?)`,
+		c.UserId,
+		c.Name,
+		c.Kind,
+		string(c.Config),
+	)
+	if err != nil {
+		return err
+	}
+
+	c.Id, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	log.Println("Channel.Create", c)
+	return nil
+}
+
+// Delete removes the channel and its name from the channels of the timers
+// in the same transaction. Timers left without channels notify all the
+// user's channels.
+func (c *Channel) Delete() error {
+	tx, err := c.Database.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var name string
+	err = tx.QueryRow(`SELECT name FROM Channel WHERE id=? AND user_id=?`, c.Id, c.UserId).Scan(&name)
+	if err == sql.ErrNoRows {
+		return errors.New("Channel not found")
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM Channel WHERE id=? AND user_id=?`, c.Id, c.UserId); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT id, channels FROM Timer WHERE user_id=?`, c.UserId)
+	if err != nil {
+		return err
+	}
+	updated := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var raw string
+		if err := rows.Scan(&id, &raw); err != nil {
+			rows.Close()
+			return err
+		}
+		var names []string
+		if json.Unmarshal([]byte(raw), &names) != nil || !contains(names, name) {
+			continue
+		}
+		rest := []string{}
+		for _, x := range names {
+			if x != name {
+				rest = append(rest, x)
+			}
+		}
+		b, _ := json.Marshal(rest)
+		updated[id] = string(b)
+	}
+	rows.Close()
+	for id, channels := range updated {
+		if _, err := tx.Exec(`UPDATE Timer SET channels=? WHERE id=?`, channels, id); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	c.Name = name
+	log.Println("Channel.Delete", c)
+	return nil
+}
+
+func (p *Database) GetChannels(userid int64) []*Channel {
+	cs := []*Channel{}
+	rows, err := p.db.Query(`SELECT id, name, kind, config FROM Channel WHERE user_id=? ORDER BY id`, userid)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c := p.NewChannel()
+		c.UserId = userid
+		var config string
+		if err := rows.Scan(&c.Id, &c.Name, &c.Kind, &config); err != nil {
+			log.Fatal(err)
+		}
+		c.Config = json.RawMessage(config)
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+func (p *Database) GetChannel(userid int64, name string) *Channel {
+	for _, c := range p.GetChannels(userid) {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// createDefaultChannel adds the default Telegram channel for the user.
+func (p *Database) createDefaultChannel(userid int64) error {
+	c := p.NewChannel()
+	c.UserId = userid
+	c.Name = DefaultChannel
+	c.Kind = "telegram"
+	return c.Create()
+}
+
+// Notify queues the notification to the channels of the user and starts
+// delivering it right away. Failed deliveries are retried by ProcessOutbox.
+func (p *Database) Notify(n *Notification) {
+	cs := p.GetChannels(n.UserId)
+	channels := n.Channels
+	if len(channels) > 0 {
+		found := false
+		for _, c := range cs {
+			found = found || contains(channels, c.Name)
+		}
+		if !found {
+			// Not to miss the alert, send it everywhere
+			log.Println("WARNING: Database.Notify, no channel of", channels, "exists, using all channels")
+			channels = nil
+		}
+	}
+
+	for _, c := range cs {
+		if len(channels) > 0 && !contains(channels, c.Name) {
+			continue
+		}
+		if !c.accepts(n) {
+			continue
+		}
+		id, err := p.enqueue(c, n)
+		if err != nil {
+			log.Println("WARNING: Database.Notify", c.Name, err)
+			continue
+		}
+		OutboxFirstAttempt(func() { p.deliver(id) })
+	}
+}
+
+// notify logs the state change of the timer and sends the notification.
+func (t *Timer) notify(nType, from, text string) {
+	t.notifyExit(nType, from, text, NoExitCode)
+}
+
+func (t *Timer) notifyExit(nType, from, text string, exitCode int) {
+	t.record(nType, from, 0, exitCode)
+	t.Database.Notify(&Notification{
+		Type:     nType,
+		TimerId:  t.Id,
+		UserId:   t.UserId,
+		Name:     t.Name,
+		From:     from,
+		State:    t.State,
+		Expiry:   t.Expiry,
+		Time:     time.Now().Unix(),
+		Text:     text,
+		Channels: t.Channels,
+	})
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,250 @@
+package lib
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+// Mock points for testing
+var OutboxBackoff = 30 * time.Second
+var OutboxMaxAttempts = 8
+
+// OutboxFirstAttempt runs the first delivery attempt of a new notification,
+// in the background so that slow channels do not block the caller
+var OutboxFirstAttempt = func(deliver func()) { go deliver() }
+
+// How long a delivery attempt holds its entry. Longer than the slowest
+// notifier, so that attempts of the same entry cannot overlap.
+const outboxLease = 5 * time.Minute
+
+// How long delivered messages are kept in the outbox
+const outboxRetention = 7 * 24 * time.Hour
+
+// OutboxEntry is a notification queued to a channel. State is "pending"
+// until delivered ("sent") or given up after OutboxMaxAttempts ("dead").
+type OutboxEntry struct {
+	Id           int64         `json:"id"`
+	UserId       int64         `json:"-"`
+	ChannelId    int64         `json:"-"`
+	Channel      string        `json:"channel"`
+	Notification *Notification `json:"notification"`
+	State        string        `json:"state"`
+	Attempts     int           `json:"attempts"`
+	NextAttempt  int64         `json:"next_attempt"`
+	LastError    string        `json:"last_error"`
+	Created      int64         `json:"created"`
+}
+
+const outboxColumns = `id, user_id, channel_id, channel, payload, state, attempts, next_attempt, last_error, created`
+
+func scanOutboxEntry(row scanner) (*OutboxEntry, error) {
+	e := &OutboxEntry{}
+	var payload string
+	err := row.Scan(&e.Id, &e.UserId, &e.ChannelId, &e.Channel, &payload, &e.State, &e.Attempts, &e.NextAttempt, &e.LastError, &e.Created)
+	if err != nil {
+		return nil, err
+	}
+	e.Notification = &Notification{}
+	if err := json.Unmarshal([]byte(payload), e.Notification); err != nil {
+		return nil, err
+	}
+	e.Notification.UserId = e.UserId
+	return e, nil
+}
+
+// enqueue stores the notification for the channel. The entry is claimed
+// for the first delivery attempt made by the caller.
+func (p *Database) enqueue(c *Channel, n *Notification) (int64, error) {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	res, err := p.db.Exec(
+		`INSERT INTO Outbox (user_id, channel_id, channel, payload, state, next_attempt, created)
+		VALUES (?, ?, ?, ?, 'pending', ?, ?)`,
+		n.UserId,
+		c.Id,
+		c.Name,
+		string(payload),
+		now.Add(outboxLease).Unix(),
+		now.Unix(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (p *Database) getChannelById(id, userid int64) (*Channel, error) {
+	c := p.NewChannel()
+	c.Id = id
+	c.UserId = userid
+	var config string
+	err := p.db.QueryRow(`SELECT name, kind, config FROM Channel WHERE id=? AND user_id=?`, id, userid).Scan(&c.Name, &c.Kind, &config)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Channel deleted")
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Config = json.RawMessage(config)
+	return c, nil
+}
+
+// claim reserves a due entry for a delivery attempt, unless another attempt
+// has claimed it meanwhile.
+func (p *Database) claim(id int64) bool {
+	now := time.Now()
+	res, err := p.db.Exec(
+		`UPDATE Outbox SET next_attempt=? WHERE id=? AND state='pending' AND next_attempt<=?`,
+		now.Add(outboxLease).Unix(),
+		id,
+		now.Unix(),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+// deliver makes one delivery attempt of a claimed pending entry.
+func (p *Database) deliver(id int64) {
+	e, err := scanOutboxEntry(p.db.QueryRow(`SELECT `+outboxColumns+` FROM Outbox WHERE id=? AND state='pending'`, id))
+	if err != nil {
+		log.Println("WARNING: Outbox.deliver", id, err)
+		return
+	}
+
+	// Errors in the channel itself are permanent, so they are not retried
+	permanent := true
+	kind := "unknown"
+	c, err := p.getChannelById(e.ChannelId, e.UserId)
+	if err == nil {
+		kind = c.Kind
+		var notifier Notifier
+		notifier, err = c.Notifier()
+		if err == nil {
+			permanent = false
+			err = notifier.Notify(e.Notification)
+		}
+	}
+	countNotification(kind, err)
+
+	if err == nil {
+		_, err = p.db.Exec(`UPDATE Outbox SET state='sent', attempts=attempts+1, last_error='' WHERE id=?`, id)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	log.Println("WARNING: Outbox.deliver", id, e.Channel, err)
+
+	attempts := e.Attempts + 1
+	state := "pending"
+	if attempts >= OutboxMaxAttempts || permanent {
+		state = "dead"
+	}
+
+	// Exponential backoff, capped at one hour
+	delay := OutboxBackoff
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+
+	_, err2 := p.db.Exec(
+		`UPDATE Outbox SET state=?, attempts=?, next_attempt=?, last_error=? WHERE id=?`,
+		state,
+		attempts,
+		time.Now().Add(delay).Unix(),
+		err.Error(),
+		id,
+	)
+	if err2 != nil {
+		log.Fatal(err2)
+	}
+}
+
+// ProcessOutbox retries the pending notifications that are due and removes
+// old delivered ones.
+func (p *Database) ProcessOutbox() int {
+	now := time.Now()
+	ids := make([]int64, 0, 100)
+
+	rows, err := p.db.Query(`SELECT id FROM Outbox WHERE state='pending' AND next_attempt<=? ORDER BY id LIMIT ?`, now.Unix(), cap(ids))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			log.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if p.claim(id) {
+			p.deliver(id)
+		}
+	}
+
+	_, err = p.db.Exec(`DELETE FROM Outbox WHERE state='sent' AND created<?`, now.Add(-outboxRetention).Unix())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return len(ids)
+}
+
+// GetOutbox returns the user's queued notifications in the given state,
+// newest first.
+func (p *Database) GetOutbox(userid int64, state string, limit int) []*OutboxEntry {
+	es := []*OutboxEntry{}
+	rows, err := p.db.Query(
+		`SELECT `+outboxColumns+` FROM Outbox WHERE user_id=? AND state=? ORDER BY id DESC LIMIT ?`,
+		userid,
+		state,
+		limit,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanOutboxEntry(rows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		es = append(es, e)
+	}
+	return es
+}
+
+// RetryOutbox queues a dead notification again.
+func (p *Database) RetryOutbox(id, userid int64) error {
+	res, err := p.db.Exec(
+		`UPDATE Outbox SET state='pending', attempts=0, next_attempt=? WHERE id=? AND user_id=? AND state='dead'`,
+		time.Now().Unix(),
+		id,
+		userid,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Notification not found")
+	}
+	return nil
+}
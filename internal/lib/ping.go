@@ -0,0 +1,251 @@
+package lib
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/ksuid"
+)
+
+// Timers are pinged at /ping/<uuid> or /ping/<ping key>/<slug>, optionally
+// followed by /start, /fail or /<exit status> as in healthchecks.io. The
+// ping key is a secret of the user that can be rotated separately from the
+// login key, and the slug is a URL-friendly timer name unique per user.
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Interval of the timers created by a ping of an unknown slug
+const AutoCreateInterval = 86400
+
+// slugify returns the name in lowercase with the runs of other characters
+// than letters and digits replaced with '-'.
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if b.Len() == 0 {
+		return "timer"
+	}
+	return b.String()
+}
+
+// uniqueSlug returns base, or base with a number appended if another timer
+// of the user than exceptid has it already.
+func (p *Database) uniqueSlug(userid, exceptid int64, base string) string {
+	slug := base
+	for i := 2; ; i++ {
+		t := p.GetTimerBySlug(userid, slug)
+		if t == nil || t.Id == exceptid {
+			return slug
+		}
+		slug = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// initPing gives a ping key, slugs and UUIDs to the users and timers
+// created before them.
+func (p *Database) initPing() {
+	rows, err := p.db.Query(`SELECT id FROM User WHERE ping_key=''`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			log.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		if _, err := p.RotatePingKey(id); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	rows, err = p.db.Query(`SELECT id, user_id, name, slug, uuid FROM Timer WHERE slug='' OR uuid='' ORDER BY id`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ts := []*Timer{}
+	for rows.Next() {
+		t := p.NewTimer()
+		if err := rows.Scan(&t.Id, &t.UserId, &t.Name, &t.Slug, &t.UUID); err != nil {
+			log.Fatal(err)
+		}
+		ts = append(ts, t)
+	}
+	rows.Close()
+	for _, t := range ts {
+		if t.Slug == "" {
+			t.Slug = p.uniqueSlug(t.UserId, t.Id, slugify(t.Name))
+		}
+		if t.UUID == "" {
+			t.UUID = newUUID()
+		}
+		if _, err := p.db.Exec(`UPDATE Timer SET slug=?, uuid=? WHERE id=?`, t.Slug, t.UUID, t.Id); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	qs := [...]string{
+		`CREATE UNIQUE INDEX IF NOT EXISTS TimerIndexSlug ON Timer (user_id, slug)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS TimerIndexUUID ON Timer (uuid)`,
+	}
+	for _, q := range qs {
+		if _, err := p.db.Exec(q); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func (p *Database) GetTimerBySlug(userid int64, slug string) *Timer {
+	row := p.db.QueryRow(`SELECT `+timerColumns+` FROM Timer WHERE user_id=? AND slug=?`, userid, slug)
+	t, err := p.scanTimer(row)
+	if err != nil {
+		return nil
+	}
+	return t
+}
+
+func (p *Database) GetTimerByUUID(uuid string) *Timer {
+	row := p.db.QueryRow(`SELECT `+timerColumns+` FROM Timer WHERE uuid=?`, uuid)
+	t, err := p.scanTimer(row)
+	if err != nil {
+		return nil
+	}
+	return t
+}
+
+// RotateUUID replaces the UUID of the timer, so that its old UUID ping
+// URLs stop working.
+func (t *Timer) RotateUUID() error {
+	uuid := newUUID()
+	res, err := t.Database.db.Exec(`UPDATE Timer SET uuid=? WHERE id=? AND user_id=?`, uuid, t.Id, t.UserId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Timer not found")
+	}
+	t.UUID = uuid
+	log.Println("Timer.RotateUUID", t.Id)
+	return nil
+}
+
+// PingSettings are the user's settings of the ping URLs
+type PingSettings struct {
+	PingKey string `json:"ping_key"`
+	// Create a timer on the first ping of an unknown slug
+	AutoCreate bool `json:"auto_create"`
+}
+
+func (p *Database) GetPingSettings(userid int64) (*PingSettings, error) {
+	s := &PingSettings{}
+	err := p.db.QueryRow(`SELECT ping_key, auto_create FROM User WHERE id=?`, userid).Scan(&s.PingKey, &s.AutoCreate)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *Database) SetAutoCreate(userid int64, autoCreate bool) error {
+	_, err := p.db.Exec(`UPDATE User SET auto_create=? WHERE id=?`, autoCreate, userid)
+	return err
+}
+
+// RotatePingKey replaces the ping key of the user, so that the old ping
+// URLs stop working.
+func (p *Database) RotatePingKey(userid int64) (string, error) {
+	key := ksuid.New().String()
+	res, err := p.db.Exec(`UPDATE User SET ping_key=? WHERE id=?`, key, userid)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", errors.New("User not found")
+	}
+	log.Println("Database.RotatePingKey", userid)
+	return key, nil
+}
+
+// pingAction returns the operation of a ping URL suffix: start, fail or an
+// exit status, or a kick without a suffix.
+func pingAction(suffix string) (func(t *Timer) error, error) {
+	switch suffix {
+	case "":
+		return (*Timer).Kick, nil
+	case "start":
+		return (*Timer).Start, nil
+	case "fail":
+		return func(t *Timer) error { return t.Fail(NoExitCode) }, nil
+	}
+
+	exitCode, err := strconv.Atoi(suffix)
+	if err != nil || exitCode < 0 || exitCode > 255 {
+		return nil, errors.New("Invalid exit status")
+	}
+	if exitCode == 0 {
+		return (*Timer).Kick, nil
+	}
+	return func(t *Timer) error { return t.Fail(exitCode) }, nil
+}
+
+// GetTimerByPing returns the timer of the ping URL. If the slug is unknown
+// and the user has opted in, a timer is created for it by the source.
+func (p *Database) GetTimerByPing(pingKey, slug string, source *EventSource) (*Timer, error) {
+	var userid int64
+	var autoCreate bool
+	err := p.db.QueryRow(`SELECT id, auto_create FROM User WHERE ping_key=?`, pingKey).Scan(&userid, &autoCreate)
+	if err != nil {
+		return nil, errors.New("Timer not found")
+	}
+
+	if t := p.GetTimerBySlug(userid, slug); t != nil {
+		return t, nil
+	}
+	if !autoCreate {
+		return nil, errors.New("Timer not found")
+	}
+
+	t := p.NewTimer()
+	t.UserId = userid
+	t.Name = slug
+	t.Slug = slug
+	t.Interval = AutoCreateInterval
+	t.Source = source
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	if err := t.Create(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
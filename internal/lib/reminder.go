@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// firstReminder returns the time of the first reminder for a timer that
+// goes down at now, or 0 if reminders are disabled.
+func (t *Timer) firstReminder(now int64) int64 {
+	if t.Reminder <= 0 {
+		return 0
+	}
+	return now + t.Reminder
+}
+
+// nextReminder returns the time of the reminder following the given number
+// of sent reminders, or 0 if no more reminders are sent.
+func (t *Timer) nextReminder(now, sent int64) int64 {
+	if t.Reminder <= 0 || (t.ReminderMax > 0 && sent >= t.ReminderMax) {
+		return 0
+	}
+
+	delay := t.Reminder
+	if t.ReminderBackoff {
+		// Cap the doubling so that the delay cannot overflow
+		for i := int64(0); i < sent && delay < 365*24*3600; i++ {
+			delay *= 2
+		}
+	}
+	return now + delay
+}
+
+// Remind sends a reminder of a timer that is still expired or failed.
+func (t *Timer) Remind() {
+	now := time.Now().Unix()
+	sent := t.Reminders + 1
+
+	res, err := t.Database.db.Exec(
+		`UPDATE Timer SET reminders=?, next_reminder=? WHERE id=? AND next_reminder=? AND state=?`,
+		sent,
+		t.nextReminder(now, sent),
+		t.Id,
+		t.NextReminder,
+		t.State,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Kicked meanwhile
+		return
+	}
+
+	log.Println("Timer.Remind", t)
+
+	downtime := time.Duration(now-t.Expiry) * time.Second
+	msg := fmt.Sprintf("Reminder: timer '%s' is still %s, down for %s", t.Name, t.State, downtime)
+	t.notify(NotifyReminder, t.State, msg)
+}
+
+func (p *Database) ProcessReminders() int {
+	now := time.Now().Unix()
+	s := make([]*Timer, 0, 1000)
+
+	// Collect all timers with a due reminder
+	rows, err := p.db.Query(
+		`SELECT `+timerColumns+` FROM Timer
+		WHERE state IN ('expired', 'failed') AND next_reminder>0 AND next_reminder<=?
+		LIMIT ?`,
+		now,
+		cap(s),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for rows.Next() {
+		t, err := p.scanTimer(rows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s = append(s, t)
+	}
+	rows.Close()
+
+	for _, t := range s {
+		t.Remind()
+	}
+
+	return len(s)
+}
+
+// Acknowledge records who is handling the expired or failed timer and
+// stops the reminders until the timer goes down again.
+func (t *Timer) Acknowledge(by string) error {
+	now := time.Now().Unix()
+	res, err := t.Database.db.Exec(
+		`UPDATE Timer SET acked=?, acked_by=?, next_reminder=0
+		WHERE id=? AND user_id=? AND state IN ('expired', 'failed')`,
+		now,
+		by,
+		t.Id,
+		t.UserId,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Timer is not down")
+	}
+	t.Acked = now
+	t.AckedBy = by
+	t.NextReminder = 0
+
+	log.Println("Timer.Acknowledge", t)
+
+	t.notify(NotifyAcked, t.State, fmt.Sprintf("Timer '%s' acknowledged by %s", t.Name, by))
+
+	return nil
+}
+
+// Snooze postpones the next reminder of the expired or failed timer. A
+// reminder is sent after the snooze even if reminders are disabled.
+func (t *Timer) Snooze(by string, seconds int64) error {
+	next := time.Now().Unix() + seconds
+	res, err := t.Database.db.Exec(
+		`UPDATE Timer SET acked=0, acked_by='', next_reminder=?
+		WHERE id=? AND user_id=? AND state IN ('expired', 'failed')`,
+		next,
+		t.Id,
+		t.UserId,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("Timer is not down")
+	}
+	t.Acked = 0
+	t.AckedBy = ""
+	t.NextReminder = next
+
+	log.Println("Timer.Snooze", t)
+
+	snooze := time.Duration(seconds) * time.Second
+	t.notify(NotifySnoozed, t.State, fmt.Sprintf("Timer '%s' snoozed for %s by %s", t.Name, snooze, by))
+
+	return nil
+}
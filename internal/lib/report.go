@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Report describes the reliability of a timer over a time range, computed
+// from its event log
+type Report struct {
+	TimerId int64  `json:"timerid"`
+	Name    string `json:"name"`
+	From    int64  `json:"from"`
+	To      int64  `json:"to"`
+	// Seconds the timer was monitored, i.e. not new or paused
+	Monitored int64 `json:"monitored"`
+	// Seconds the timer was expired or failed
+	Downtime int64 `json:"downtime"`
+	// Percentage of the monitored time the timer was up
+	Uptime    float64 `json:"uptime"`
+	Incidents int     `json:"incidents"`
+	// Mean time to recovery of the incidents that ended within the range
+	MTTR          int64 `json:"mttr"`
+	LongestOutage int64 `json:"longest_outage"`
+}
+
+// Default range of the reports
+const DefaultReportDays = 30
+
+func isDown(state string) bool {
+	return state == "expired" || state == "failed"
+}
+
+func isMonitored(state string) bool {
+	return state != "" && state != "new" && state != "paused" && state != "deleted"
+}
+
+// Report computes the reliability of the timer from from to to. An
+// incident ongoing at either end is counted up to that end.
+func (t *Timer) Report(from, to int64) *Report {
+	r := &Report{
+		TimerId: t.Id,
+		Name:    t.Name,
+		From:    from,
+		To:      to,
+		Uptime:  100,
+	}
+	end := to
+	if now := time.Now().Unix(); end > now {
+		end = now
+	}
+	if end <= from {
+		return r
+	}
+
+	// State at the beginning of the range
+	state := ""
+	err := t.Database.db.QueryRow(
+		`SELECT state FROM Event WHERE timer_id=? AND ts<? AND state<>'' ORDER BY id DESC LIMIT 1`,
+		t.Id,
+		from,
+	).Scan(&state)
+	if err != nil && err != sql.ErrNoRows {
+		log.Fatal(err)
+	}
+
+	type change struct {
+		ts    int64
+		from  string
+		state string
+	}
+	changes := []change{}
+	rows, err := t.Database.db.Query(
+		`SELECT ts, from_state, state FROM Event
+		WHERE timer_id=? AND ts>=? AND ts<? AND state<>''
+		ORDER BY id`,
+		t.Id,
+		from,
+		end,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for rows.Next() {
+		var c change
+		if err := rows.Scan(&c.ts, &c.from, &c.state); err != nil {
+			log.Fatal(err)
+		}
+		changes = append(changes, c)
+	}
+	rows.Close()
+
+	// Without earlier events, the first event tells the previous state
+	if state == "" {
+		if len(changes) > 0 {
+			state = changes[0].from
+		} else {
+			state = t.State
+		}
+	}
+
+	var downSince, resolved, resolvedDowntime int64
+	if isDown(state) {
+		downSince = from
+		r.Incidents++
+	}
+	last := from
+	advance := func(until int64) {
+		if isMonitored(state) {
+			r.Monitored += until - last
+		}
+		if isDown(state) {
+			r.Downtime += until - last
+		}
+		last = until
+	}
+
+	for _, c := range changes {
+		advance(c.ts)
+		if !isDown(state) && isDown(c.state) {
+			r.Incidents++
+			downSince = c.ts
+		} else if isDown(state) && !isDown(c.state) {
+			d := c.ts - downSince
+			resolved++
+			resolvedDowntime += d
+			if d > r.LongestOutage {
+				r.LongestOutage = d
+			}
+		}
+		state = c.state
+	}
+	advance(end)
+	if isDown(state) && end-downSince > r.LongestOutage {
+		r.LongestOutage = end - downSince
+	}
+
+	if resolved > 0 {
+		r.MTTR = resolvedDowntime / resolved
+	}
+	if r.Monitored > 0 {
+		r.Uptime = 100 * float64(r.Monitored-r.Downtime) / float64(r.Monitored)
+	}
+	return r
+}
+
+// GetReports returns the reports of all timers of the user.
+func (p *Database) GetReports(userid, from, to int64) []*Report {
+	ts := p.GetTimers(userid)
+	rs := make([]*Report, len(ts))
+	for i, t := range ts {
+		rs[i] = t.Report(from, to)
+	}
+	return rs
+}
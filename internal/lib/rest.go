@@ -2,6 +2,7 @@ package lib
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"log"
@@ -31,19 +32,142 @@ func getTimer(c echo.Context, db *Database) *Timer {
 	}
 	userid = getUser(c)
 	t := db.GetTimer(id, userid)
+	if t != nil {
+		t.Source = requestSource(c)
+	}
 	return t
 }
 
+// getReportRange returns the from and to query parameters, by default the
+// last DefaultReportDays days.
+func getReportRange(c echo.Context) (from, to int64, err error) {
+	to = time.Now().Unix()
+	if s := c.QueryParam("to"); s != "" {
+		if to, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("Invalid to")
+		}
+	}
+	from = to - DefaultReportDays*24*3600
+	if s := c.QueryParam("from"); s != "" {
+		if from, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("Invalid from")
+		}
+	}
+	if from >= to {
+		return 0, 0, fmt.Errorf("Invalid range")
+	}
+	return from, to, nil
+}
+
+// requestSource returns the origin of the request for the event log.
+func requestSource(c echo.Context) *EventSource {
+	return &EventSource{
+		IP:        c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+	}
+}
+
+// getTimerByToken returns the timer identified by the kick token in the URL.
+func getTimerByToken(c echo.Context, db *Database, hmacSecretBytes []byte) (*Timer, error) {
+	tokenString := c.Param("token")
+
+	// Validate token and extract TimerId and UserId
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method")
+		}
+		return hmacSecretBytes, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	// Tokens issued before the type claim are kick tokens too
+	if typ, ok := claims["typ"]; ok && typ != jwtTypeKick {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	timerid, ok1 := claims["timerid"].(float64)
+	userid, ok2 := claims["userid"].(float64)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	jti, ok := claims["jti"].(string)
+	if !ok {
+		// Issued before the tokens were stored
+		jti = legacyJti(int64(timerid))
+	}
+
+	// The token must not be revoked
+	k, err := db.GetTokenByJti(jti)
+	if err != nil {
+		return nil, err
+	}
+	if k.TimerId != int64(timerid) || k.UserId != int64(userid) {
+		return nil, fmt.Errorf("Invalid token")
+	}
+
+	t := db.GetTimer(int64(timerid), int64(userid))
+	if t == nil {
+		return nil, fmt.Errorf("Timer not found")
+	}
+	t.Source = requestSource(c)
+	return t, nil
+}
+
+// Types of the JWTs signed by the service, in the "typ" claim
+const (
+	jwtTypeSession = "session"
+	jwtTypeKick    = "kick"
+)
+
+// newSessionCookie returns the login cookie of the user. The session is
+// valid until the user's key is rotated.
+func newSessionCookie(db *Database, userid int64, hmacSecretBytes []byte) (*http.Cookie, error) {
+	gen, err := db.GetUserGeneration(userid)
+	if err != nil {
+		return nil, err
+	}
+
+	exp := time.Now().Add(24 * time.Hour)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"typ":    jwtTypeSession,
+		"userid": userid,
+		"gen":    gen,
+		"exp":    exp.Unix(),
+	})
+	tokenString, err := token.SignedString(hmacSecretBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	cookie := new(http.Cookie)
+	cookie.Name = "Authorization"
+	cookie.Value = tokenString
+	cookie.Expires = exp
+	return cookie, nil
+}
+
 func NewRestServer(prefix string, db *Database, hmacSecret string) (e *echo.Echo) {
 	hmacSecretBytes := []byte(hmacSecret)
 	e = echo.New()
 
+	// The rules are matched anywhere in the path unless anchored, e.g.
+	// "/ping/*" would match "/api/ping/key"
 	e.Pre(middleware.Rewrite(map[string]string{
-		prefix + "/api/*":    "/restricted/api/$1",
-		prefix + "/":         "/",
-		prefix + "/login":    "/login",
-		prefix + "/static/*": "/static/$1",
-		prefix + "/kick/*":   "/kick/$1",
+		"^" + prefix + "/api/*":          "/restricted/api/$1",
+		"^" + prefix + "/":               "/",
+		"^" + prefix + "/login":          "/login",
+		"^" + prefix + "/static/*":       "/static/$1",
+		"^" + prefix + "/kick/*":         "/kick/$1",
+		"^" + prefix + "/telegram/*":     "/telegram/$1",
+		"^" + prefix + "/ping/*":         "/ping/$1",
+		"^" + prefix + "/alertmanager/*": "/alertmanager/$1",
+		"^" + prefix + "/metrics":        "/metrics",
 	}))
 
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
@@ -65,6 +189,12 @@ func NewRestServer(prefix string, db *Database, hmacSecret string) (e *echo.Echo
 		return c.HTML(http.StatusOK, tmplBuf.String())
 	})
 
+	// Prometheus metrics
+	e.GET("/metrics", handleMetrics(db))
+
+	// Telegram updates in the webhook mode
+	e.POST("/telegram/:secret", handleTelegramWebhook)
+
 	// Login
 	e.POST("/login", func(c echo.Context) error {
 		key := c.FormValue("key")
@@ -78,23 +208,11 @@ func NewRestServer(prefix string, db *Database, hmacSecret string) (e *echo.Echo
 			return c.String(http.StatusUnauthorized, "Failed to login\n")
 		}
 
-		exp := time.Now().Add(24 * time.Hour)
-
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"userid": userid,
-			"exp":    exp.Unix(),
-		})
-		tokenString, err := token.SignedString(hmacSecretBytes)
-
+		cookie, err := newSessionCookie(db, userid, hmacSecretBytes)
 		if err != nil {
 			fmt.Println(err)
 			return c.String(http.StatusUnauthorized, "Failed to login\n")
 		}
-
-		cookie := new(http.Cookie)
-		cookie.Name = "Authorization"
-		cookie.Value = tokenString
-		cookie.Expires = exp
 		c.SetCookie(cookie)
 
 		//return c.String(http.StatusMovedPermanently, "/")
@@ -109,6 +227,46 @@ func NewRestServer(prefix string, db *Database, hmacSecret string) (e *echo.Echo
 		TokenLookup: "cookie:Authorization",
 	}))
 
+	// Sessions of a rotated key are revoked
+	g.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			claims := c.Get("user").(*jwt.Token).Claims.(jwt.MapClaims)
+			// Kick tokens are signed with the same secret but are no sessions
+			typ, _ := claims["typ"].(string)
+			_, hasTimer := claims["timerid"]
+			_, hasJti := claims["jti"]
+			if typ != jwtTypeSession || hasTimer || hasJti {
+				return c.String(http.StatusUnauthorized, "Invalid session\n")
+			}
+			gen, _ := claims["gen"].(float64)
+			current, err := db.GetUserGeneration(getUser(c))
+			if err != nil || int64(gen) != current {
+				return c.String(http.StatusUnauthorized, "Session revoked\n")
+			}
+			return next(c)
+		}
+	})
+
+	// Rotate access key
+	g.POST("/api/key", func(c echo.Context) error {
+		userid := getUser(c)
+		key, err := db.RotateUserKey(userid)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to rotate key")
+		}
+
+		// Keep the current session logged in with the new key
+		cookie, err := newSessionCookie(db, userid, hmacSecretBytes)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to rotate key")
+		}
+		c.SetCookie(cookie)
+
+		return c.JSON(http.StatusOK, struct {
+			Key string `json:"key"`
+		}{key})
+	})
+
 	// Create timer
 	g.POST("/api/timer", func(c echo.Context) error {
 		var err error
@@ -125,8 +283,24 @@ func NewRestServer(prefix string, db *Database, hmacSecret string) (e *echo.Echo
 
 		t := db.NewTimer()
 		t.Name = rt.Name
+		t.Slug = rt.Slug
 		t.Interval = rt.Interval
+		t.Grace = rt.Grace
+		t.Schedule = rt.Schedule
+		t.Timezone = rt.Timezone
+		t.MaxRuntime = rt.MaxRuntime
+		t.Reminder = rt.Reminder
+		t.ReminderMax = rt.ReminderMax
+		t.ReminderBackoff = rt.ReminderBackoff
+		if rt.Channels != nil {
+			t.Channels = rt.Channels
+		}
 		t.UserId = getUser(c)
+		t.Source = requestSource(c)
+
+		if err := t.Validate(); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
 
 		err = t.Create()
 
@@ -166,24 +340,112 @@ func NewRestServer(prefix string, db *Database, hmacSecret string) (e *echo.Echo
 		return c.JSON(http.StatusOK, t)
 	})
 
-	// Get timer JWT
+	// Get timer JWT of the default token, created on the first call
 	g.GET("/api/timer/:id/token", func(c echo.Context) error {
 		t := getTimer(c, db)
 		if t == nil {
 			return c.String(http.StatusNotFound, "Timer not found")
 		}
 
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"userid":  t.UserId,
-			"timerid": t.Id,
-		})
-		tokenString, err := token.SignedString(hmacSecretBytes)
+		k := db.GetTokenByName(t.Id, t.UserId, DefaultTokenName)
+		if k == nil {
+			k = db.NewToken()
+			k.TimerId = t.Id
+			k.UserId = t.UserId
+			k.Name = DefaultTokenName
+			if err := k.Create(); err != nil {
+				return c.String(http.StatusInternalServerError, "Failed to create token")
+			}
+		}
 
-		if err != nil {
+		if err := k.Sign(hmacSecretBytes); err != nil {
 			fmt.Println(err)
 		}
 
-		return c.String(http.StatusOK, tokenString)
+		return c.String(http.StatusOK, k.Token)
+	})
+
+	// Create named timer token
+	g.POST("/api/timer/:id/token", func(c echo.Context) error {
+		t := getTimer(c, db)
+		if t == nil {
+			return c.String(http.StatusNotFound, "Timer not found")
+		}
+
+		rk := Token{}
+		if err := c.Bind(&rk); err != nil {
+			log.Println("POST /api/timer/:id/token - bind error", err)
+			return c.String(http.StatusBadRequest, "Invalid token")
+		}
+
+		k := db.NewToken()
+		k.TimerId = t.Id
+		k.UserId = t.UserId
+		k.Name = rk.Name
+		k.Expiry = rk.Expiry
+		if err := k.Validate(); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if db.GetTokenByName(t.Id, t.UserId, k.Name) != nil {
+			return c.String(http.StatusBadRequest, "Token name already in use")
+		}
+		if err := k.Create(); err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to create token")
+		}
+		if err := k.Sign(hmacSecretBytes); err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to create token")
+		}
+
+		return c.JSON(http.StatusOK, k)
+	})
+
+	// Get list of timer tokens
+	g.GET("/api/timer/:id/tokens", func(c echo.Context) error {
+		t := getTimer(c, db)
+		if t == nil {
+			return c.String(http.StatusNotFound, "Timer not found")
+		}
+
+		ks := db.GetTokens(t.Id, t.UserId)
+		for _, k := range ks {
+			if err := k.Sign(hmacSecretBytes); err != nil {
+				return c.String(http.StatusInternalServerError, "Failed to sign token")
+			}
+		}
+		return c.JSON(http.StatusOK, ks)
+	})
+
+	// Revoke timer token
+	g.DELETE("/api/timer/:id/token/:tokenid", func(c echo.Context) error {
+		t := getTimer(c, db)
+		if t == nil {
+			return c.String(http.StatusNotFound, "Timer not found")
+		}
+		id, err := strconv.ParseInt(c.Param("tokenid"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Token not found")
+		}
+
+		k := db.NewToken()
+		k.Id = id
+		k.TimerId = t.Id
+		k.UserId = t.UserId
+		if err := k.Revoke(); err != nil {
+			return c.String(http.StatusNotFound, "Token not found")
+		}
+		return c.String(http.StatusOK, "Token revoked")
+	})
+
+	// Replace the UUID of the ping URLs
+	g.POST("/api/timer/:id/uuid", func(c echo.Context) error {
+		t := getTimer(c, db)
+		if t == nil {
+			return c.String(http.StatusNotFound, "Timer not found")
+		}
+		if err := t.RotateUUID(); err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to rotate uuid")
+		}
+		return c.JSON(http.StatusOK, t)
 	})
 
 	// Kick timer
@@ -193,34 +455,443 @@ func NewRestServer(prefix string, db *Database, hmacSecret string) (e *echo.Echo
 			return c.String(http.StatusNotFound, "Timer not found")
 		}
 
-		t.Kick()
+		if err := t.Kick(); err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to kick timer")
+		}
 		return c.String(http.StatusOK, "Timer kicked")
 	})
 
+	// Pause timer
+	g.POST("/api/timer/:id/pause", func(c echo.Context) error {
+		t := getTimer(c, db)
+		if t == nil {
+			return c.String(http.StatusNotFound, "Timer not found")
+		}
+
+		if err := t.Pause(); err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to pause timer")
+		}
+		return c.String(http.StatusOK, "Timer paused")
+	})
+
+	// Resume timer
+	g.POST("/api/timer/:id/resume", func(c echo.Context) error {
+		t := getTimer(c, db)
+		if t == nil {
+			return c.String(http.StatusNotFound, "Timer not found")
+		}
+
+		if err := t.Resume(); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.String(http.StatusOK, "Timer resumed")
+	})
+
+	// Get finished job runs
+	g.GET("/api/timer/:id/runs", func(c echo.Context) error {
+		t := getTimer(c, db)
+		if t == nil {
+			return c.String(http.StatusNotFound, "Timer not found")
+		}
+
+		return c.JSON(http.StatusOK, t.GetRuns(100))
+	})
+
+	// Get timer uptime report
+	g.GET("/api/timer/:id/report", func(c echo.Context) error {
+		t := getTimer(c, db)
+		if t == nil {
+			return c.String(http.StatusNotFound, "Timer not found")
+		}
+		from, to, err := getReportRange(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusOK, t.Report(from, to))
+	})
+
+	// Get uptime reports of all timers
+	g.GET("/api/report", func(c echo.Context) error {
+		from, to, err := getReportRange(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusOK, db.GetReports(getUser(c), from, to))
+	})
+
+	// Get timer event log, newest first. The next page is requested with
+	// before set to the ID of the last event.
+	g.GET("/api/timer/:id/events", func(c echo.Context) error {
+		t := getTimer(c, db)
+		if t == nil {
+			return c.String(http.StatusNotFound, "Timer not found")
+		}
+
+		limit := 100
+		if s := c.QueryParam("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > 1000 {
+				return c.String(http.StatusBadRequest, "Invalid limit")
+			}
+			limit = n
+		}
+		var before int64
+		if s := c.QueryParam("before"); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 1 {
+				return c.String(http.StatusBadRequest, "Invalid before")
+			}
+			before = n
+		}
+
+		return c.JSON(http.StatusOK, t.GetEvents(before, limit))
+	})
+
+	// Create maintenance window
+	g.POST("/api/maintenance", func(c echo.Context) error {
+		rm := Maintenance{}
+		if err := c.Bind(&rm); err != nil {
+			log.Println("POST /api/maintenance - bind error", err)
+			return err
+		}
+
+		m := db.NewMaintenance()
+		m.UserId = getUser(c)
+		m.Name = rm.Name
+		m.Start = rm.Start
+		m.End = rm.End
+		m.Schedule = rm.Schedule
+		m.Timezone = rm.Timezone
+		m.Duration = rm.Duration
+		if rm.Timers != nil {
+			m.Timers = rm.Timers
+		}
+
+		if err := m.Validate(); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		if err := m.Create(); err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to create maintenance window")
+		}
+		return c.JSON(http.StatusOK, m)
+	})
+
+	// Get list of maintenance windows
+	g.GET("/api/maintenance", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, db.GetMaintenances(getUser(c), 0))
+	})
+
+	// Delete maintenance window
+	g.DELETE("/api/maintenance/:id", func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Maintenance window not found")
+		}
+
+		m := db.NewMaintenance()
+		m.Id = id
+		m.UserId = getUser(c)
+		if err := m.Delete(); err != nil {
+			return c.String(http.StatusNotFound, "Maintenance window not found")
+		}
+		return c.String(http.StatusOK, "Maintenance window deleted")
+	})
+
+	// Create notification channel
+	g.POST("/api/channel", func(c echo.Context) error {
+		rc := Channel{}
+		if err := c.Bind(&rc); err != nil {
+			log.Println("POST /api/channel - bind error", err)
+			return err
+		}
+
+		ch := db.NewChannel()
+		ch.UserId = getUser(c)
+		ch.Name = rc.Name
+		ch.Kind = rc.Kind
+		ch.Config = rc.Config
+
+		if err := ch.Validate(); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if ch.Kind == "telegram" && !db.isOwnTelegramChat(ch) {
+			return c.String(http.StatusBadRequest, "Use /bind in the Telegram chat to add it as a channel")
+		}
+
+		if err := ch.Create(); err != nil {
+			return c.String(http.StatusBadRequest, "Failed to create channel")
+		}
+		return c.JSON(http.StatusOK, ch)
+	})
+
+	// Get list of notification channels
+	g.GET("/api/channel", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, db.GetChannels(getUser(c)))
+	})
+
+	// Delete notification channel
+	g.DELETE("/api/channel/:id", func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Channel not found")
+		}
+
+		ch := db.NewChannel()
+		ch.Id = id
+		ch.UserId = getUser(c)
+		if err := ch.Delete(); err != nil {
+			return c.String(http.StatusNotFound, "Channel not found")
+		}
+		return c.String(http.StatusOK, "Channel deleted")
+	})
+
+	// Get queued notifications, the undeliverable ones by default
+	g.GET("/api/outbox", func(c echo.Context) error {
+		state := c.QueryParam("state")
+		if state == "" {
+			state = "dead"
+		}
+		if state != "pending" && state != "sent" && state != "dead" {
+			return c.String(http.StatusBadRequest, "Invalid state")
+		}
+		return c.JSON(http.StatusOK, db.GetOutbox(getUser(c), state, 100))
+	})
+
+	// Retry undeliverable notification
+	g.POST("/api/outbox/:id/retry", func(c echo.Context) error {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			return c.String(http.StatusNotFound, "Notification not found")
+		}
+		if err := db.RetryOutbox(id, getUser(c)); err != nil {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		return c.String(http.StatusOK, "Notification queued")
+	})
+
 	// Modify timer
-	// e.PUT()
+	g.PUT("/api/timer/:id", func(c echo.Context) error {
+		t := getTimer(c, db)
+		if t == nil {
+			return c.String(http.StatusNotFound, "Timer not found")
+		}
 
-	e.GET("/kick/:token", func(c echo.Context) error {
-		tokenString := c.Param("token")
+		changes := TimerChanges{}
+		if err := c.Bind(&changes); err != nil {
+			log.Println("PUT /api/timer - bind error", err)
+			return err
+		}
+
+		if err := t.Update(&changes); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		return c.JSON(http.StatusOK, t)
+	})
+
+	// Ping settings
+	g.GET("/api/ping", func(c echo.Context) error {
+		ps, err := db.GetPingSettings(getUser(c))
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get ping settings")
+		}
+		return c.JSON(http.StatusOK, ps)
+	})
+
+	// Modify ping settings, only auto_create can be set
+	g.PUT("/api/ping", func(c echo.Context) error {
+		rp := PingSettings{}
+		if err := c.Bind(&rp); err != nil {
+			log.Println("PUT /api/ping - bind error", err)
+			return c.String(http.StatusBadRequest, "Invalid ping settings")
+		}
+		userid := getUser(c)
+		if err := db.SetAutoCreate(userid, rp.AutoCreate); err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to modify ping settings")
+		}
+		ps, err := db.GetPingSettings(userid)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get ping settings")
+		}
+		return c.JSON(http.StatusOK, ps)
+	})
+
+	// Rotate ping key
+	g.POST("/api/ping/key", func(c echo.Context) error {
+		userid := getUser(c)
+		if _, err := db.RotatePingKey(userid); err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to rotate ping key")
+		}
+		ps, err := db.GetPingSettings(userid)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get ping settings")
+		}
+		return c.JSON(http.StatusOK, ps)
+	})
+
+	// Get digest settings
+	g.GET("/api/digest", func(c echo.Context) error {
+		ds, err := db.GetDigestSettings(getUser(c))
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to get digest settings")
+		}
+		return c.JSON(http.StatusOK, ds)
+	})
+
+	// Modify digest settings, only schedule and timezone can be set
+	g.PUT("/api/digest", func(c echo.Context) error {
+		rd := DigestSettings{}
+		if err := c.Bind(&rd); err != nil {
+			log.Println("PUT /api/digest - bind error", err)
+			return c.String(http.StatusBadRequest, "Invalid digest settings")
+		}
+		ds, err := db.SetDigestSchedule(getUser(c), rd.Schedule, rd.Timezone)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusOK, ds)
+	})
 
-		// Validate token and extract TimerId and UserId
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("Unexpected signing method")
+	// healthchecks.io compatible pings: /ping/<uuid>[/<action>] and
+	// /ping/<ping key>/<slug>[/<action>]. A request body is accepted but
+	// not used.
+	ping := func(c echo.Context) error {
+		args := c.ParamValues()
+		t := db.GetTimerByUUID(args[0])
+		suffix := ""
+		if t != nil {
+			if len(args) > 2 {
+				return c.String(http.StatusNotFound, "Timer not found")
+			}
+			if len(args) == 2 {
+				suffix = args[1]
 			}
-			return hmacSecretBytes, nil
-		})
-
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			timerid := int64(claims["timerid"].(float64))
-			userid := int64(claims["userid"].(float64))
-			t := db.GetTimer(timerid, userid)
-			t.Kick()
-			return c.String(http.StatusOK, "Timer kicked")
 		} else {
+			if len(args) < 2 {
+				return c.String(http.StatusNotFound, "Timer not found")
+			}
+			if len(args) == 3 {
+				suffix = args[2]
+			}
+		}
+
+		// Checked before a timer is created by the ping
+		action, err := pingAction(suffix)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		if t == nil {
+			t, err = db.GetTimerByPing(args[0], args[1], requestSource(c))
+			if err != nil {
+				return c.String(http.StatusNotFound, err.Error())
+			}
+		}
+		t.Source = requestSource(c)
+
+		if err := action(t); err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to ping timer")
+		}
+		return c.String(http.StatusOK, "OK")
+	}
+	methods := []string{"GET", "HEAD", "POST"}
+	e.Match(methods, "/ping/:id", ping)
+	e.Match(methods, "/ping/:id/:arg", ping)
+	e.Match(methods, "/ping/:id/:arg/:action", ping)
+
+	// Alertmanager webhook receiver, the firing alert kicks the timer. If
+	// Alertmanager stops sending it, the timer expires.
+	e.POST("/alertmanager/:token", func(c echo.Context) error {
+		t, err := getTimerByToken(c, db, hmacSecretBytes)
+		if err != nil {
+			fmt.Println(err)
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		payload := alertmanagerPayload{}
+		if err := json.NewDecoder(c.Request().Body).Decode(&payload); err != nil {
+			return c.String(http.StatusBadRequest, "Invalid payload")
+		}
+
+		alertname := c.QueryParam("alertname")
+		if alertname == "" {
+			alertname = DefaultAlertName
+		}
+		// Other alerts are not errors, Alertmanager would retry them
+		if !payload.firing(alertname) {
+			return c.String(http.StatusOK, "No matching alert")
+		}
+
+		if err := t.Kick(); err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to kick timer")
+		}
+		return c.String(http.StatusOK, "Timer kicked")
+	})
+
+	e.GET("/kick/:token", func(c echo.Context) error {
+		t, err := getTimerByToken(c, db, hmacSecretBytes)
+		if err != nil {
+			fmt.Println(err)
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		if err := t.Kick(); err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to kick timer")
+		}
+		return c.String(http.StatusOK, "Timer kicked")
+	})
+
+	e.GET("/kick/:token/start", func(c echo.Context) error {
+		t, err := getTimerByToken(c, db, hmacSecretBytes)
+		if err != nil {
 			fmt.Println(err)
 			return c.String(http.StatusBadRequest, err.Error())
 		}
+
+		if err := t.Start(); err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to start timer")
+		}
+		return c.String(http.StatusOK, "Timer started")
+	})
+
+	e.GET("/kick/:token/fail", func(c echo.Context) error {
+		t, err := getTimerByToken(c, db, hmacSecretBytes)
+		if err != nil {
+			fmt.Println(err)
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		if err := t.Fail(NoExitCode); err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to fail timer")
+		}
+		return c.String(http.StatusOK, "Timer failed")
+	})
+
+	// Exit code 0 is a normal kick, others fail the timer
+	e.GET("/kick/:token/:exitcode", func(c echo.Context) error {
+		exitCode, err := strconv.Atoi(c.Param("exitcode"))
+		if err != nil || exitCode < 0 || exitCode > 255 {
+			return c.String(http.StatusBadRequest, "Invalid exit code")
+		}
+
+		t, err := getTimerByToken(c, db, hmacSecretBytes)
+		if err != nil {
+			fmt.Println(err)
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		if exitCode == 0 {
+			if err := t.Kick(); err != nil {
+				return c.String(http.StatusInternalServerError, "Failed to kick timer")
+			}
+			return c.String(http.StatusOK, "Timer kicked")
+		}
+
+		if err := t.Fail(exitCode); err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to fail timer")
+		}
+		return c.String(http.StatusOK, "Timer failed")
 	})
 
 	return e
@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Standard 5-field cron expressions and descriptors such as "@daily"
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+func parseSchedule(expr, timezone string) (cron.Schedule, *time.Location, error) {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid timezone '%s'", timezone)
+	}
+
+	sched, err := cronParser.Parse(expr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid schedule '%s': %s", expr, err)
+	}
+
+	return sched, loc, nil
+}
+
+// Validate checks the timer settings given by the user.
+func (t *Timer) Validate() error {
+	if t.Interval < 0 {
+		return errors.New("Invalid interval")
+	}
+	if t.Grace < 0 {
+		return errors.New("Invalid grace")
+	}
+	if t.MaxRuntime < 0 {
+		return errors.New("Invalid max_runtime")
+	}
+	if t.Reminder < 0 || t.ReminderMax < 0 {
+		return errors.New("Invalid reminder")
+	}
+	if t.Slug != "" {
+		if !slugPattern.MatchString(t.Slug) {
+			return errors.New("Invalid slug, use lowercase letters, digits, '-' and '_'")
+		}
+		if other := t.Database.GetTimerBySlug(t.UserId, t.Slug); other != nil && other.Id != t.Id {
+			return fmt.Errorf("Slug '%s' already in use", t.Slug)
+		}
+	}
+	for _, name := range t.Channels {
+		if t.Database.GetChannel(t.UserId, name) == nil {
+			return fmt.Errorf("Unknown channel '%s'", name)
+		}
+	}
+
+	if t.Schedule == "" {
+		if t.Timezone != "" {
+			return errors.New("Timezone requires a schedule")
+		}
+		if t.Interval == 0 {
+			return errors.New("Either interval or schedule is required")
+		}
+		return nil
+	}
+
+	_, _, err := parseSchedule(t.Schedule, t.Timezone)
+	return err
+}
+
+// Grace period of the scheduled timers without one. The kick of a run
+// comes only after the job has finished, i.e. after the scheduled time.
+const DefaultScheduleGrace = 3600
+
+// effectiveGrace returns the grace period of the timer.
+func (t *Timer) effectiveGrace() int64 {
+	if t.Grace == 0 && t.Schedule != "" {
+		return DefaultScheduleGrace
+	}
+	return t.Grace
+}
+
+// nextExpiry returns the time by which the next kick is expected when the
+// timer is kicked at now. With a schedule, that is the next scheduled run.
+func (t *Timer) nextExpiry(now time.Time) int64 {
+	if t.Schedule == "" {
+		return now.Unix() + t.Interval
+	}
+
+	sched, loc, err := parseSchedule(t.Schedule, t.Timezone)
+	if err != nil {
+		// Validated on create, so this should not happen
+		log.Println("WARNING: Timer.nextExpiry", t, err)
+		return now.Unix() + t.Interval
+	}
+
+	return sched.Next(now.In(loc)).Unix()
+}
@@ -1,20 +1,55 @@
 package lib
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/labstack/echo"
+	"github.com/segmentio/ksuid"
 	tb "gopkg.in/tucnak/telebot.v2"
 )
 
 var Tg *tb.Bot = nil
 var TgLoginURL string
 
+// TelegramWebhookConfig makes the bot receive its updates from Telegram at
+// <URL>/telegram/<Secret> on the REST server instead of long polling
+type TelegramWebhookConfig struct {
+	// Public URL of the service, including the WEB_PREFIX
+	URL string
+	// Path component known only to Telegram, random if empty
+	Secret string
+}
+
+var TgWebhook *TelegramWebhookConfig = nil
+
+// TelegramWebhookConfigFromEnv reads the webhook settings from the
+// environment. It returns nil, meaning long polling, if
+// TELEGRAM_WEBHOOK_URL is not set.
+func TelegramWebhookConfigFromEnv() *TelegramWebhookConfig {
+	url := os.Getenv("TELEGRAM_WEBHOOK_URL")
+	if url == "" {
+		return nil
+	}
+	return &TelegramWebhookConfig{
+		URL:    strings.TrimSuffix(url, "/"),
+		Secret: os.Getenv("TELEGRAM_WEBHOOK_SECRET"),
+	}
+}
+
 // Mock points for testing
 var InitTelegram = initTelegram
 var StartTelegram = startTelegram
 var SendTelegramMsg = sendTelegramMsg
+var AnswerTelegramCallback = answerTelegramCallback
+var NewTelegramBot = tb.NewBot
 
 func initTelegram(token string, db *Database) {
 	// Telegram connection
@@ -25,9 +60,22 @@ func initTelegram(token string, db *Database) {
 		return
 	}
 
-	bot, err := tb.NewBot(tb.Settings{
+	var poller tb.Poller = &tb.LongPoller{Timeout: 10 * time.Second}
+	if TgWebhook != nil {
+		if TgWebhook.Secret == "" {
+			TgWebhook.Secret = ksuid.New().String()
+		}
+		// Updates are posted to the REST server, the poller only
+		// registers the webhook
+		poller = &tb.Webhook{Endpoint: &tb.WebhookEndpoint{
+			PublicURL: TgWebhook.URL + "/telegram/" + TgWebhook.Secret,
+		}}
+		log.Println("Telegram webhook:", TgWebhook.URL+"/telegram/...")
+	}
+
+	bot, err := NewTelegramBot(tb.Settings{
 		Token:  token,
-		Poller: &tb.LongPoller{Timeout: 10 * time.Second},
+		Poller: poller,
 	})
 	if err != nil {
 		log.Fatal(err)
@@ -51,9 +99,46 @@ func initTelegram(token string, db *Database) {
 		}
 	})
 
+	for cmd, handler := range botCommands {
+		cmd, handler := cmd, handler
+		bot.Handle(cmd, func(m *tb.Message) {
+			log.Printf("%s received from %s - %d", cmd, m.Sender.Username, m.Sender.ID)
+			SendTelegramMsg(m.Chat.ID, runBotCommand(db, int64(m.Sender.ID), handler, m.Payload))
+		})
+	}
+
+	for cmd, handler := range chatCommands {
+		cmd, handler := cmd, handler
+		bot.Handle(cmd, func(m *tb.Message) {
+			log.Printf("%s received from %s - %d in %d", cmd, m.Sender.Username, m.Sender.ID, m.Chat.ID)
+			SendTelegramMsg(m.Chat.ID, runChatCommand(db, int64(m.Sender.ID), m.Chat, handler, m.Payload))
+		})
+	}
+
+	for _, b := range alertButtons {
+		b := b
+		bot.Handle(&tb.InlineButton{Unique: b.unique}, func(c *tb.Callback) {
+			log.Printf("%s button received from %s - %d", b.unique, c.Sender.Username, c.Sender.ID)
+			var chatId int64
+			if c.Message != nil && c.Message.Chat != nil {
+				chatId = c.Message.Chat.ID
+			}
+			reply := runAlertAction(db, int64(c.Sender.ID), chatId, senderName(c.Sender), b.action, c.Data)
+			AnswerTelegramCallback(c, reply)
+		})
+	}
+
 	Tg = bot
 }
 
+// senderName returns the name shown in the messages about the user's actions.
+func senderName(u *tb.User) string {
+	if u.Username != "" {
+		return "@" + u.Username
+	}
+	return strings.TrimSpace(u.FirstName + " " + u.LastName)
+}
+
 func startTelegram() {
 	if Tg == nil {
 		return
@@ -61,10 +146,152 @@ func startTelegram() {
 	Tg.Start()
 }
 
-func sendTelegramMsg(tgid int64, msg string) {
+// handleTelegramWebhook processes an update posted by Telegram in the
+// webhook mode.
+func handleTelegramWebhook(c echo.Context) error {
+	if Tg == nil || TgWebhook == nil ||
+		subtle.ConstantTimeCompare([]byte(c.Param("secret")), []byte(TgWebhook.Secret)) != 1 {
+		return c.String(http.StatusNotFound, "Not found")
+	}
+
+	var update tb.Update
+	if err := json.NewDecoder(c.Request().Body).Decode(&update); err != nil {
+		return c.String(http.StatusBadRequest, "Invalid update")
+	}
+	Tg.ProcessUpdate(update)
+	return c.NoContent(http.StatusOK)
+}
+
+func sendTelegramMsg(tgid int64, msg string, options ...interface{}) error {
 	if Tg == nil {
-		return
+		return nil
 	}
 	chat := tb.Chat{ID: tgid}
-	Tg.Send(&chat, msg)
+	_, err := Tg.Send(&chat, msg, options...)
+	return err
+}
+
+func answerTelegramCallback(c *tb.Callback, text string) error {
+	if Tg == nil {
+		return nil
+	}
+	return Tg.Respond(c, &tb.CallbackResponse{Text: text})
+}
+
+// alertKeyboard returns the buttons attached to the alerts of the timer.
+func alertKeyboard(timerid int64) *tb.ReplyMarkup {
+	row := make([]tb.InlineButton, len(alertButtons))
+	for i, b := range alertButtons {
+		row[i] = tb.InlineButton{
+			Unique: b.unique,
+			Text:   b.text,
+			Data:   strconv.FormatInt(timerid, 10),
+		}
+	}
+	return &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{row}}
+}
+
+// telegramNotifier sends the notification texts to a Telegram chat
+type telegramNotifier struct {
+	chatId int64
+}
+
+// Config of the "telegram" channel kind. Without a chat ID, the messages
+// are sent to the user's own chat.
+type telegramConfig struct {
+	ChatId int64 `json:"chat_id"`
+}
+
+func newTelegramNotifier(db *Database, c *Channel) (Notifier, error) {
+	var config telegramConfig
+	if err := json.Unmarshal(c.Config, &config); err != nil {
+		return nil, fmt.Errorf("Invalid telegram config: %s", err)
+	}
+
+	if config.ChatId == 0 {
+		tgid, err := db.GetUserTelegramIdById(c.UserId)
+		if err != nil {
+			return nil, err
+		}
+		config.ChatId = tgid
+	}
+
+	return &telegramNotifier{chatId: config.ChatId}, nil
+}
+
+// isOwnTelegramChat tells whether the telegram channel sends to the user's
+// own chat. Other chats are added with /bind, which proves that the user is
+// in the chat.
+func (p *Database) isOwnTelegramChat(c *Channel) bool {
+	var config telegramConfig
+	if json.Unmarshal(c.Config, &config) != nil {
+		return false
+	}
+	if config.ChatId == 0 {
+		return true
+	}
+	tgid, err := p.GetUserTelegramIdById(c.UserId)
+	return err == nil && config.ChatId == tgid
+}
+
+// telegramChatChannels returns the telegram channels of the user that send
+// to the given chat ID.
+func (p *Database) telegramChatChannels(userid, chatId int64) []*Channel {
+	cs := []*Channel{}
+	for _, c := range p.GetChannels(userid) {
+		var config telegramConfig
+		if c.Kind != "telegram" || json.Unmarshal(c.Config, &config) != nil {
+			continue
+		}
+		if config.ChatId == chatId {
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
+
+// telegramChatUsers returns the users who have bound the given chat ID.
+func (p *Database) telegramChatUsers(chatId int64) []int64 {
+	ids := []int64{}
+	if chatId == 0 {
+		return ids
+	}
+	rows, err := p.db.Query(`SELECT user_id, config FROM Channel WHERE kind='telegram' ORDER BY id`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userid int64
+		var raw string
+		if err := rows.Scan(&userid, &raw); err != nil {
+			log.Fatal(err)
+		}
+		var config telegramConfig
+		if json.Unmarshal([]byte(raw), &config) == nil && config.ChatId == chatId {
+			ids = append(ids, userid)
+		}
+	}
+	return ids
+}
+
+// Accepts skips the notifications without a message.
+func (n *telegramNotifier) Accepts(m *Notification) bool {
+	return m.Text != ""
+}
+
+func (n *telegramNotifier) Notify(m *Notification) error {
+	if !n.Accepts(m) {
+		return nil
+	}
+	switch m.Type {
+	case NotifyExpired, NotifyFailed, NotifyReminder:
+		return SendTelegramMsg(n.chatId, m.Text, alertKeyboard(m.TimerId))
+	}
+	return SendTelegramMsg(n.chatId, m.Text)
+}
+
+func init() {
+	RegisterNotifier("telegram", newTelegramNotifier)
 }
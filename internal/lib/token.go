@@ -0,0 +1,208 @@
+package lib
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/segmentio/ksuid"
+)
+
+// Token is a named kick token of a timer, e.g. one per host running the
+// job. The JWT of the token carries Jti, and the token stops working when
+// it is revoked or expires.
+type Token struct {
+	Id      int64  `json:"id"`
+	TimerId int64  `json:"timerid"`
+	UserId  int64  `json:"-"`
+	Jti     string `json:"-"`
+	Name    string `json:"name"`
+	// Expiry time, 0 if the token does not expire
+	Expiry  int64 `json:"expiry"`
+	Created int64 `json:"created"`
+	// Signed JWT used in the kick URLs
+	Token string `json:"token"`
+
+	// Other
+	Database *Database `json:"-"`
+}
+
+// Name of the token returned by GET /api/timer/:id/token
+const DefaultTokenName = "default"
+
+// Name of the token standing for the kick tokens issued before the tokens
+// were stored. Those JWTs carry no Jti.
+const LegacyTokenName = "legacy"
+
+// legacyJti returns the stored JWT ID of the legacy token of the timer.
+func legacyJti(timerid int64) string {
+	return fmt.Sprintf("legacy-%d", timerid)
+}
+
+// createLegacyTokens stores a legacy token for each existing timer.
+func (p *Database) createLegacyTokens() {
+	rows, err := p.db.Query(`SELECT id, user_id FROM Timer`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ks := []*Token{}
+	for rows.Next() {
+		k := p.NewToken()
+		if err := rows.Scan(&k.TimerId, &k.UserId); err != nil {
+			log.Fatal(err)
+		}
+		ks = append(ks, k)
+	}
+	rows.Close()
+
+	now := time.Now().Unix()
+	for _, k := range ks {
+		_, err := p.db.Exec(
+			`INSERT INTO Token (timer_id, user_id, jti, name, expiry, created) VALUES (?, ?, ?, ?, 0, ?)`,
+			k.TimerId,
+			k.UserId,
+			legacyJti(k.TimerId),
+			LegacyTokenName,
+			now,
+		)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func (p *Database) NewToken() *Token {
+	return &Token{
+		Database: p,
+	}
+}
+
+// Validate checks the token settings given by the user.
+func (k *Token) Validate() error {
+	if k.Name == "" {
+		return errors.New("Token name is required")
+	}
+	if k.Expiry < 0 || (k.Expiry > 0 && k.Expiry <= time.Now().Unix()) {
+		return errors.New("Invalid expiry")
+	}
+	return nil
+}
+
+func (k *Token) Create() error {
+	k.Jti = ksuid.New().String()
+	k.Created = time.Now().Unix()
+
+	res, err := k.Database.db.Exec(
+		`INSERT INTO Token (timer_id, user_id, jti, name, expiry, created) VALUES (?, ?, ?, ?, ?, ?)`,
+		k.TimerId,
+		k.UserId,
+		k.Jti,
+		k.Name,
+		k.Expiry,
+		k.Created,
+	)
+	if err != nil {
+		return err
+	}
+
+	k.Id, err = res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	log.Println("Token.Create", k.Id, k.TimerId, k.Name)
+	return nil
+}
+
+// Revoke deletes the token so that its kick URLs stop working.
+func (k *Token) Revoke() error {
+	res, err := k.Database.db.Exec(`DELETE FROM Token WHERE id=? AND timer_id=? AND user_id=?`, k.Id, k.TimerId, k.UserId)
+	if err != nil {
+		return err
+	}
+
+	numDeleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if numDeleted != 1 {
+		return errors.New("Token not found")
+	}
+
+	log.Println("Token.Revoke", k.Id, k.TimerId, k.Name)
+	return nil
+}
+
+// Sign sets the JWT of the token. The JWT is the same on each call.
+func (k *Token) Sign(hmacSecretBytes []byte) error {
+	claims := jwt.MapClaims{
+		"typ":     jwtTypeKick,
+		"userid":  k.UserId,
+		"timerid": k.TimerId,
+		"jti":     k.Jti,
+	}
+	if k.Expiry > 0 {
+		claims["exp"] = k.Expiry
+	}
+
+	var err error
+	k.Token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(hmacSecretBytes)
+	return err
+}
+
+const tokenColumns = `id, timer_id, user_id, jti, name, expiry, created`
+
+func (p *Database) scanToken(row scanner) (*Token, error) {
+	k := p.NewToken()
+	err := row.Scan(&k.Id, &k.TimerId, &k.UserId, &k.Jti, &k.Name, &k.Expiry, &k.Created)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (p *Database) GetTokens(timerid, userid int64) []*Token {
+	ks := []*Token{}
+	rows, err := p.db.Query(`SELECT `+tokenColumns+` FROM Token WHERE timer_id=? AND user_id=? ORDER BY id`, timerid, userid)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		k, err := p.scanToken(rows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ks = append(ks, k)
+	}
+	return ks
+}
+
+func (p *Database) GetTokenByName(timerid, userid int64, name string) *Token {
+	row := p.db.QueryRow(`SELECT `+tokenColumns+` FROM Token WHERE timer_id=? AND user_id=? AND name=?`, timerid, userid, name)
+	k, err := p.scanToken(row)
+	if err != nil {
+		return nil
+	}
+	return k
+}
+
+// GetTokenByJti returns the unexpired token with the given JWT ID.
+func (p *Database) GetTokenByJti(jti string) (*Token, error) {
+	row := p.db.QueryRow(`SELECT `+tokenColumns+` FROM Token WHERE jti=?`, jti)
+	k, err := p.scanToken(row)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("Token revoked")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if k.Expiry > 0 && k.Expiry <= time.Now().Unix() {
+		return nil, errors.New("Token expired")
+	}
+	return k, nil
+}
@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Header carrying the hex encoded HMAC-SHA256 of the request body
+const WebhookSignatureHeader = "X-Watchdog-Signature"
+
+// Mock point for testing
+var WebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Config of the "webhook" channel kind
+type webhookConfig struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// webhookNotifier posts the notifications as JSON to an URL
+type webhookNotifier struct {
+	config webhookConfig
+}
+
+func newWebhookNotifier(db *Database, c *Channel) (Notifier, error) {
+	var config webhookConfig
+	if err := json.Unmarshal(c.Config, &config); err != nil {
+		return nil, fmt.Errorf("Invalid webhook config: %s", err)
+	}
+
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("Invalid webhook url")
+	}
+	if config.Secret == "" {
+		return nil, errors.New("Webhook secret is required")
+	}
+
+	return &webhookNotifier{config: config}, nil
+}
+
+// WebhookSignature returns the signature of the body with the secret.
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify posts the notification once; failed requests are retried
+// through the outbox.
+func (n *webhookNotifier) Notify(m *Notification) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", n.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, WebhookSignature(n.config.Secret, body))
+
+	rsp, err := WebhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return fmt.Errorf("Webhook returned status %d", rsp.StatusCode)
+	}
+	return nil
+}
+
+func init() {
+	RegisterNotifier("webhook", newWebhookNotifier)
+}
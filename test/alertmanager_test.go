@@ -0,0 +1,53 @@
+package main_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func alertmanagerPayload(status, alertname string) string {
+	return `{"version": "4", "status": "` + status + `", "receiver": "watchdog",
+		"alerts": [{"status": "` + status + `", "labels": {"alertname": "` + alertname + `", "severity": "none"}}]}`
+}
+
+func TestAlertmanager(t *testing.T) {
+	timer := addTimer(t, "Alertmanager", 60)
+	token := getTimerToken(t, timer)
+	mockTelegram(t, testUser.TgId)
+
+	for _, tc := range []struct {
+		query string
+		body  string
+		code  int
+		state string
+	}{
+		{"", alertmanagerPayload("firing", "HighLoad"), http.StatusOK, "new"},
+		{"", alertmanagerPayload("resolved", "Watchdog"), http.StatusOK, "new"},
+		{"", "{", http.StatusBadRequest, "new"},
+		{"", alertmanagerPayload("firing", "Watchdog"), http.StatusOK, "running"},
+		{"?alertname=DeadMansSwitch", alertmanagerPayload("firing", "Watchdog"), http.StatusOK, "running"},
+	} {
+		req, _ := http.NewRequest("POST", "/alertmanager/"+token+tc.query, strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		checkResponseCode(t, tc.code, executeRequest(req).Code)
+		if s := getTimer(t, timer).State; s != tc.state {
+			t.Errorf("%s %s: expected state %s, got %s", tc.query, tc.body, tc.state, s)
+		}
+	}
+
+	// The alert name is configurable
+	before := getTimer(t, timer).Kicked
+	req, _ := http.NewRequest("POST", "/alertmanager/"+token+"?alertname=DeadMansSwitch",
+		strings.NewReader(alertmanagerPayload("firing", "DeadMansSwitch")))
+	rsp := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rsp.Code)
+	if body := rsp.Body.String(); body != "Timer kicked" || getTimer(t, timer).Kicked < before {
+		t.Error("Timer not kicked", body)
+	}
+
+	req, _ = http.NewRequest("POST", "/alertmanager/"+token+"x", strings.NewReader(alertmanagerPayload("firing", "Watchdog")))
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+
+	deleteTimer(t, timer, true)
+}
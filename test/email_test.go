@@ -0,0 +1,126 @@
+package main_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pkorpine/go-watchdog/internal/lib"
+)
+
+// fakeSMTP accepts mails without authentication and sends their data to
+// the returned channel.
+func fakeSMTP(t *testing.T) (net.Listener, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mails := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				fmt.Fprintf(conn, "220 fake ESMTP\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					cmd := strings.ToUpper(strings.TrimSpace(line))
+					switch {
+					case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+						fmt.Fprintf(conn, "250 fake\r\n")
+					case strings.HasPrefix(cmd, "DATA"):
+						fmt.Fprintf(conn, "354 go ahead\r\n")
+						var data strings.Builder
+						for {
+							l, err := r.ReadString('\n')
+							if err != nil {
+								return
+							}
+							if l == ".\r\n" {
+								break
+							}
+							data.WriteString(l)
+						}
+						mails <- data.String()
+						fmt.Fprintf(conn, "250 queued\r\n")
+					case strings.HasPrefix(cmd, "QUIT"):
+						fmt.Fprintf(conn, "221 bye\r\n")
+						return
+					default:
+						fmt.Fprintf(conn, "250 ok\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return l, mails
+}
+
+func TestEmail(t *testing.T) {
+	l, mails := fakeSMTP(t)
+	defer l.Close()
+	addr := l.Addr().(*net.TCPAddr)
+
+	// Channel can not be created without a mail server
+	lib.InitEmail(nil)
+	doJSON(t, "POST", "/api/channel", `{"name": "mail", "kind": "email", "config": {"to": "ops@example.com"}}`, http.StatusBadRequest, nil)
+
+	lib.InitEmail(&lib.SmtpConfig{
+		Host: "127.0.0.1",
+		Port: addr.Port,
+		From: "watchdog@example.com",
+	})
+	defer lib.InitEmail(nil)
+
+	ch := lib.Channel{}
+	doJSON(t, "POST", "/api/channel", `{"name": "mail", "kind": "email", "config": {"to": "ops@example.com"}}`, http.StatusOK, &ch)
+	doJSON(t, "POST", "/api/channel", `{"name": "mail2", "kind": "email", "config": {"to": "not an address"}}`, http.StatusBadRequest, nil)
+
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		return nil
+	}
+	timer := lib.Timer{}
+	doJSON(t, "POST", "/api/timer", `{"name": "Mailed", "interval": 60, "channels": ["mail"]}`, http.StatusOK, &timer)
+	token := getTimerToken(t, timer)
+	kickTimerWithToken(t, timer, token)
+
+	// Only failures and recoveries are mailed
+	req, _ := http.NewRequest("GET", "/kick/"+token+"/2", nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	kickTimerWithToken(t, timer, token)
+
+	for _, expected := range []string{
+		"Subject: [go-watchdog] Timer 'Mailed' failed\r\n",
+		"Subject: [go-watchdog] Timer 'Mailed' recovered\r\n",
+	} {
+		select {
+		case mail := <-mails:
+			if !strings.Contains(mail, expected) {
+				t.Error("Incorrect mail", mail)
+			}
+			if !strings.Contains(mail, "To: <ops@example.com>\r\n") {
+				t.Error("Incorrect recipient", mail)
+			}
+		default:
+			t.Error("Mail not sent:", expected)
+		}
+	}
+	select {
+	case mail := <-mails:
+		t.Error("Unexpected mail", mail)
+	default:
+	}
+
+	doJSON(t, "DELETE", fmt.Sprintf("/api/timer/%d", timer.Id), "", http.StatusOK, nil)
+	doJSON(t, "DELETE", fmt.Sprintf("/api/channel/%d", ch.Id), "", http.StatusOK, nil)
+}
@@ -1,6 +1,7 @@
 package main_test
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,10 +10,13 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/pkorpine/go-watchdog/internal/lib"
 )
 
@@ -22,6 +26,7 @@ var testUser = lib.User{
 	TgId: 123,
 }
 var cookies []*http.Cookie
+var initTelegram = lib.InitTelegram
 
 func TestMain(m *testing.M) {
 	db := "sqlite_test.db"
@@ -36,7 +41,12 @@ func TestMain(m *testing.M) {
 		log.Println("Mock StartTelegram")
 	}
 
-	a.Initialize(db, "", "")
+	// Deliver notifications synchronously
+	lib.OutboxFirstAttempt = func(deliver func()) {
+		deliver()
+	}
+
+	a.Initialize(db, "", "", "secret")
 
 	// Fill database
 	created := a.DB.CreateOrGetUserKeyByTelegramId(&testUser)
@@ -98,6 +108,27 @@ func kickTimerWithToken(t *testing.T, timer lib.Timer, token string) {
 	checkResponseCode(t, http.StatusOK, rsp.Code)
 }
 
+func startTimerWithToken(t *testing.T, timer lib.Timer, token string) {
+	url := "/kick/" + token + "/start"
+	req, _ := http.NewRequest("GET", url, nil)
+	rsp := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rsp.Code)
+}
+
+func getTimerRuns(t *testing.T, timer lib.Timer) []lib.Run {
+	url := fmt.Sprintf("/api/timer/%d/runs", timer.Id)
+	req, _ := http.NewRequest("GET", url, nil)
+	req.AddCookie(cookies[0])
+	rsp := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rsp.Code)
+	runs := []lib.Run{}
+	j := json.NewDecoder(rsp.Body).Decode(&runs)
+	if j != nil {
+		t.Error("JSON fail")
+	}
+	return runs
+}
+
 func getTimerToken(t *testing.T, timer lib.Timer) string {
 	url := fmt.Sprintf("/api/timer/%d/token", timer.Id)
 	req, _ := http.NewRequest("GET", url, nil)
@@ -112,7 +143,11 @@ func getTimerToken(t *testing.T, timer lib.Timer) string {
 }
 
 func addTimer(t *testing.T, name string, interval int64) lib.Timer {
-	lib.SendTelegramMsg = func(tgid int64, msg string) {
+	return addTimerJSON(t, name, fmt.Sprintf(`{"name": "%s", "interval": %d}`, name, interval))
+}
+
+func addTimerJSON(t *testing.T, name string, p string) lib.Timer {
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
 		if tgid != testUser.TgId {
 			t.Error("SendTelegramMsg - incorrect tgid")
 		}
@@ -120,8 +155,8 @@ func addTimer(t *testing.T, name string, interval int64) lib.Timer {
 		if msg != fmt.Sprintf("Timer '%s' created", name) {
 			t.Error("SendTelegramMsg - inval")
 		}
+		return nil
 	}
-	p := fmt.Sprintf(`{"name": "%s", "interval": %d}`, name, interval)
 	req, _ := http.NewRequest("POST", "/api/timer", strings.NewReader(p))
 	req.Header.Set("Content-Type", "application/json")
 	req.AddCookie(cookies[0])
@@ -136,7 +171,7 @@ func addTimer(t *testing.T, name string, interval int64) lib.Timer {
 }
 
 func deleteTimer(t *testing.T, timer lib.Timer, exists bool) {
-	lib.SendTelegramMsg = func(tgid int64, msg string) {
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
 		if tgid != testUser.TgId {
 			t.Error("SendTelegramMsg - incorrect tgid")
 		}
@@ -144,6 +179,7 @@ func deleteTimer(t *testing.T, timer lib.Timer, exists bool) {
 		if msg != fmt.Sprintf("Timer '%s' deleted", timer.Name) {
 			t.Error("SendTelegramMsg - inval")
 		}
+		return nil
 	}
 	url := fmt.Sprintf("/api/timer/%d", timer.Id)
 	req, _ := http.NewRequest("DELETE", url, nil)
@@ -183,7 +219,7 @@ func TestAPI(t *testing.T) {
 		t.Error("Timer list expected to be 1")
 		t.FailNow()
 	}
-	if timers[0] != timer1 {
+	if !reflect.DeepEqual(timers[0], timer1) {
 		t.Error("Incorrect timer in list")
 	}
 
@@ -205,7 +241,7 @@ func TestAPI(t *testing.T) {
 	}
 
 	// Wait and process expired timers
-	lib.SendTelegramMsg = func(tgid int64, msg string) {
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
 		if tgid != testUser.TgId {
 			t.Error("SendTelegramMsg - incorrect tgid")
 		}
@@ -213,6 +249,7 @@ func TestAPI(t *testing.T) {
 		if msg != fmt.Sprintf("Timer '%s' has expired", timer1.Name) {
 			t.Error("SendTelegramMsg - inval", msg)
 		}
+		return nil
 	}
 
 	time.Sleep(time.Second * time.Duration(INTERVAL+1))
@@ -229,14 +266,16 @@ func TestAPI(t *testing.T) {
 	token := getTimerToken(t, timer1)
 
 	// Kick expired timer using JWT
-	lib.SendTelegramMsg = func(tgid int64, msg string) {
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
 		if tgid != testUser.TgId {
 			t.Error("SendTelegramMsg - incorrect tgid")
 		}
 
-		if msg != fmt.Sprintf("Expired timer '%s' kicked", timer1.Name) {
+		prefix := fmt.Sprintf("Timer '%s' recovered after ", timer1.Name)
+		if !strings.HasPrefix(msg, prefix) || !strings.Contains(msg, "of downtime (last success ") {
 			t.Error("SendTelegramMsg - inval", msg)
 		}
+		return nil
 	}
 	kickTimerWithToken(t, timer1, token)
 
@@ -260,6 +299,908 @@ func TestAPI(t *testing.T) {
 	deleteTimer(t, timer1, false)
 }
 
+func TestConcurrentKicks(t *testing.T) {
+	timers := make([]lib.Timer, 20)
+	for i := range timers {
+		timers[i] = addTimer(t, fmt.Sprintf("Concurrent %d", i), 60)
+	}
+	mockTelegram(t, testUser.TgId)
+
+	var wg sync.WaitGroup
+	for _, timer := range timers {
+		wg.Add(1)
+		go func(timer lib.Timer) {
+			defer wg.Done()
+			kickTimer(t, timer)
+		}(timer)
+	}
+	wg.Wait()
+	for _, timer := range timers {
+		if s := getTimer(t, timer).State; s != "running" {
+			t.Error("Timer not kicked", timer.Name, s)
+		}
+	}
+
+	// Concurrent kicks of an expired timer recover it once
+	expired := addTimer(t, "Concurrent expired", 1)
+	mockTelegram(t, testUser.TgId)
+	kickTimer(t, expired)
+	time.Sleep(2 * time.Second)
+	a.DB.ProcessExpiredTimers()
+
+	var mu sync.Mutex
+	recovered := 0
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasPrefix(msg, "Timer 'Concurrent expired' recovered") {
+			recovered++
+		}
+		return nil
+	}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			kickTimer(t, expired)
+		}()
+	}
+	wg.Wait()
+	if recovered != 1 {
+		t.Error("Expected one recovery, got", recovered)
+	}
+
+	mockTelegram(t, testUser.TgId)
+	for _, timer := range append(timers, expired) {
+		deleteTimer(t, timer, true)
+	}
+}
+
+func TestGrace(t *testing.T) {
+	timer := addTimerJSON(t, "Grace", `{"name": "Grace", "interval": 1, "grace": 2}`)
+	if timer.Grace != 2 {
+		t.Error("New timer - incorrect grace")
+	}
+	kickTimer(t, timer)
+
+	// Overdue but within the grace period
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		t.Error("SendTelegramMsg - unexpected message", msg)
+		return nil
+	}
+	time.Sleep(2 * time.Second)
+	a.DB.ProcessExpiredTimers()
+	if s := getTimer(t, timer).State; s != "late" {
+		t.Error("Timer not late", s)
+	}
+
+	// Grace period passed
+	mockTelegram(t, testUser.TgId)
+	time.Sleep(2 * time.Second)
+	a.DB.ProcessExpiredTimers()
+	if s := getTimer(t, timer).State; s != "expired" {
+		t.Error("Timer not expired", s)
+	}
+
+	deleteTimer(t, timer, true)
+}
+
+func TestSchedule(t *testing.T) {
+	timer := addTimerJSON(t, "Nightly", `{"name": "Nightly", "schedule": "0 2 * * 1-5", "timezone": "Europe/Helsinki"}`)
+	if timer.Schedule != "0 2 * * 1-5" || timer.Timezone != "Europe/Helsinki" {
+		t.Error("New timer - incorrect schedule", timer)
+	}
+
+	now := time.Now()
+	kickTimer(t, timer)
+	expiry := time.Unix(getTimer(t, timer).Expiry, 0)
+	loc, _ := time.LoadLocation("Europe/Helsinki")
+	local := expiry.In(loc)
+	if local.Hour() != 2 || local.Minute() != 0 {
+		t.Error("Expiry not at 02:00", local)
+	}
+	if local.Weekday() == time.Saturday || local.Weekday() == time.Sunday {
+		t.Error("Expiry not on a weekday", local)
+	}
+	if !expiry.After(now) || expiry.After(now.Add(4*24*time.Hour)) {
+		t.Error("Expiry not the next run", local)
+	}
+
+	deleteTimer(t, timer, true)
+}
+
+func TestScheduleKickAfterRun(t *testing.T) {
+	lenient := addTimerJSON(t, "Lenient", `{"name": "Lenient", "schedule": "@every 2s"}`)
+	strict := addTimerJSON(t, "Strict", `{"name": "Strict", "schedule": "@every 2s", "grace": 1}`)
+	mockTelegram(t, testUser.TgId)
+	kickTimer(t, lenient)
+	kickTimer(t, strict)
+	if e := getTimer(t, lenient).Expiry - time.Now().Unix(); e < 1 || e > 2 {
+		t.Error("Expiry not the next run", e)
+	}
+
+	// Past the scheduled run, only the timer with a short grace expires
+	sent := []string{}
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		sent = append(sent, msg)
+		return nil
+	}
+	time.Sleep(4 * time.Second)
+	a.DB.ProcessExpiredTimers()
+	if s := getTimer(t, lenient).State; s != "late" {
+		t.Error("Timer not late", s)
+	}
+	if s := getTimer(t, strict).State; s != "expired" {
+		t.Error("Timer not expired", s)
+	}
+
+	// The kick after the run is no recovery
+	kickTimer(t, lenient)
+	if len(sent) != 1 || sent[0] != "Timer 'Strict' has expired" {
+		t.Error("Incorrect messages", sent)
+	}
+
+	mockTelegram(t, testUser.TgId)
+	deleteTimer(t, lenient, true)
+	deleteTimer(t, strict, true)
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	for _, p := range []string{
+		`{"name": "Bad", "schedule": "0 25 * * *"}`,
+		`{"name": "Bad", "schedule": "@daily", "timezone": "Mars/Olympus"}`,
+		`{"name": "Bad"}`,
+	} {
+		req, _ := http.NewRequest("POST", "/api/timer", strings.NewReader(p))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(cookies[0])
+		rsp := executeRequest(req)
+		checkResponseCode(t, http.StatusBadRequest, rsp.Code)
+	}
+}
+
+func TestStartFinish(t *testing.T) {
+	timer := addTimerJSON(t, "Backup", `{"name": "Backup", "interval": 60, "max_runtime": 1}`)
+	token := getTimerToken(t, timer)
+
+	// Finished run
+	startTimerWithToken(t, timer, token)
+	if s := getTimer(t, timer).State; s != "started" {
+		t.Error("Timer not started", s)
+	}
+	kickTimerWithToken(t, timer, token)
+	if s := getTimer(t, timer).State; s != "running" {
+		t.Error("Timer not running", s)
+	}
+	runs := getTimerRuns(t, timer)
+	if len(runs) != 1 || runs[0].Duration < 0 || runs[0].Duration > 1 {
+		t.Error("Incorrect runs", runs)
+	}
+
+	// Run exceeding the max runtime
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		if msg != "Timer 'Backup' started but did not finish in time" {
+			t.Error("SendTelegramMsg - inval", msg)
+		}
+		return nil
+	}
+	startTimerWithToken(t, timer, token)
+	time.Sleep(2 * time.Second)
+	a.DB.ProcessExpiredTimers()
+	if s := getTimer(t, timer).State; s != "expired" {
+		t.Error("Timer not expired", s)
+	}
+
+	deleteTimer(t, timer, true)
+}
+
+func TestFail(t *testing.T) {
+	timer := addTimer(t, "Job", 60)
+	token := getTimerToken(t, timer)
+	kickTimerWithToken(t, timer, token)
+
+	for _, tc := range []struct {
+		path string
+		code int
+		msg  string
+	}{
+		{"/fail", http.StatusOK, "Timer 'Job' failed"},
+		{"/0", http.StatusOK, "Timer 'Job' recovered after "},
+		{"/3", http.StatusOK, "Timer 'Job' failed with exit code 3"},
+		{"/256", http.StatusBadRequest, ""},
+		{"/x", http.StatusBadRequest, ""},
+	} {
+		sent := ""
+		lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+			sent = msg
+			return nil
+		}
+		req, _ := http.NewRequest("GET", "/kick/"+token+tc.path, nil)
+		rsp := executeRequest(req)
+		checkResponseCode(t, tc.code, rsp.Code)
+		if !strings.HasPrefix(sent, tc.msg) || (tc.msg == "" && sent != "") {
+			t.Errorf("%s: expected message %q, got %q", tc.path, tc.msg, sent)
+		}
+	}
+
+	if s := getTimer(t, timer).State; s != "failed" {
+		t.Error("Timer not failed", s)
+	}
+
+	deleteTimer(t, timer, true)
+}
+
+func TestReminders(t *testing.T) {
+	timer := addTimerJSON(t, "Remind", `{"name": "Remind", "interval": 1, "reminder": 1, "reminder_max": 2}`)
+	kickTimer(t, timer)
+
+	mockTelegram(t, testUser.TgId)
+	time.Sleep(2 * time.Second)
+	a.DB.ProcessExpiredTimers()
+	if s := getTimer(t, timer).State; s != "expired" {
+		t.Error("Timer not expired", s)
+	}
+
+	// Two reminders, then nothing more
+	sent := 0
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		if !strings.HasPrefix(msg, "Reminder: timer 'Remind' is still expired, down for ") {
+			t.Error("SendTelegramMsg - inval", msg)
+		}
+		sent++
+		return nil
+	}
+	for i := 0; i < 3; i++ {
+		time.Sleep(1100 * time.Millisecond)
+		a.DB.ProcessReminders()
+	}
+	if sent != 2 {
+		t.Error("Expected 2 reminders, got", sent)
+	}
+	if r := getTimer(t, timer).Reminders; r != 2 {
+		t.Error("Expected reminder count 2, got", r)
+	}
+
+	deleteTimer(t, timer, true)
+}
+
+func postTimer(t *testing.T, timer lib.Timer, action string, code int) {
+	url := fmt.Sprintf("/api/timer/%d/%s", timer.Id, action)
+	req, _ := http.NewRequest("POST", url, nil)
+	req.AddCookie(cookies[0])
+	rsp := executeRequest(req)
+	checkResponseCode(t, code, rsp.Code)
+}
+
+func TestPauseResume(t *testing.T) {
+	timer := addTimer(t, "Pause", 1)
+	kickTimer(t, timer)
+
+	// Paused while overdue, before the expiry processing gets to it
+	mockTelegram(t, testUser.TgId)
+	time.Sleep(2 * time.Second)
+	overdue := a.DB.GetTimer(timer.Id, testUser.Id)
+	postTimer(t, timer, "pause", http.StatusOK)
+	overdue.Expire()
+	a.DB.ProcessExpiredTimers()
+	if s := getTimer(t, timer).State; s != "paused" {
+		t.Error("Timer not paused", s)
+	}
+
+	postTimer(t, timer, "resume", http.StatusOK)
+	if s := getTimer(t, timer).State; s != "running" {
+		t.Error("Timer not running", s)
+	}
+	postTimer(t, timer, "resume", http.StatusBadRequest)
+
+	deleteTimer(t, timer, true)
+}
+
+func TestMaintenance(t *testing.T) {
+	timer := addTimer(t, "Maint", 1)
+	other := addTimer(t, "Other", 100)
+	kickTimer(t, timer)
+
+	// Window covering the timer right now
+	now := time.Now().Unix()
+	p := fmt.Sprintf(`{"name": "Deploy", "start": %d, "end": %d, "timers": [%d]}`, now-10, now+3600, timer.Id)
+	req, _ := http.NewRequest("POST", "/api/maintenance", strings.NewReader(p))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(cookies[0])
+	rsp := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rsp.Code)
+	m := lib.Maintenance{}
+	if err := json.NewDecoder(rsp.Body).Decode(&m); err != nil {
+		t.Error("JSON fail")
+	}
+	if len(m.Timers) != 1 || m.Timers[0] != timer.Id {
+		t.Error("Incorrect maintenance timers", m)
+	}
+
+	// Recurring window that is not active for hours
+	future := time.Now().UTC().Add(3 * time.Hour)
+	p = fmt.Sprintf(`{"name": "Nightly", "schedule": "%d %d * * *", "duration": 60, "timers": [%d]}`, future.Minute(), future.Hour(), other.Id)
+	req, _ = http.NewRequest("POST", "/api/maintenance", strings.NewReader(p))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(cookies[0])
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	// Invalid window
+	req, _ = http.NewRequest("POST", "/api/maintenance", strings.NewReader(`{"name": "Bad", "start": 10, "end": 5}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(cookies[0])
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+
+	mockTelegram(t, testUser.TgId)
+	time.Sleep(2 * time.Second)
+	a.DB.ProcessExpiredTimers()
+	if s := getTimer(t, timer).State; s != "running" {
+		t.Error("Timer expired during maintenance", s)
+	}
+
+	// Remove the windows
+	req, _ = http.NewRequest("GET", "/api/maintenance", nil)
+	req.AddCookie(cookies[0])
+	rsp = executeRequest(req)
+	ms := []lib.Maintenance{}
+	if err := json.NewDecoder(rsp.Body).Decode(&ms); err != nil || len(ms) != 2 {
+		t.Error("Incorrect maintenance list", ms)
+	}
+	for _, m := range ms {
+		req, _ = http.NewRequest("DELETE", fmt.Sprintf("/api/maintenance/%d", m.Id), nil)
+		req.AddCookie(cookies[0])
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	}
+
+	a.DB.ProcessExpiredTimers()
+	if s := getTimer(t, timer).State; s != "expired" {
+		t.Error("Timer not expired after maintenance", s)
+	}
+
+	deleteTimer(t, timer, true)
+	deleteTimer(t, other, true)
+}
+
+func putTimer(t *testing.T, timer lib.Timer, p string, code int) lib.Timer {
+	url := fmt.Sprintf("/api/timer/%d", timer.Id)
+	req, _ := http.NewRequest("PUT", url, strings.NewReader(p))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(cookies[0])
+	rsp := executeRequest(req)
+	checkResponseCode(t, code, rsp.Code)
+	timerRsp := lib.Timer{}
+	if code == http.StatusOK {
+		if err := json.NewDecoder(rsp.Body).Decode(&timerRsp); err != nil {
+			t.Error("JSON fail")
+		}
+	}
+	return timerRsp
+}
+
+func TestModify(t *testing.T) {
+	timer := addTimer(t, "Modify", 60)
+	token := getTimerToken(t, timer)
+	kickTimer(t, timer)
+	kicked := getTimer(t, timer).Kicked
+
+	sent := ""
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		sent = msg
+		return nil
+	}
+	timer2 := putTimer(t, timer, `{"name": "Modified", "interval": 120}`, http.StatusOK)
+	if timer2.Name != "Modified" || timer2.Interval != 120 || timer2.Grace != 0 {
+		t.Error("Timer not modified", timer2)
+	}
+	if timer2.Expiry != kicked+120 {
+		t.Error("Expiry not recomputed", timer2.Expiry, kicked)
+	}
+	if sent != "Timer 'Modify' modified: name 'Modify' -> 'Modified', interval 60 -> 120" {
+		t.Error("SendTelegramMsg - inval", sent)
+	}
+	if !reflect.DeepEqual(getTimer(t, timer), timer2) {
+		t.Error("Modified timer not stored")
+	}
+
+	// Invalid and unchanged settings
+	putTimer(t, timer, `{"grace": -1}`, http.StatusBadRequest)
+	putTimer(t, timer, `{"schedule": "bad"}`, http.StatusBadRequest)
+	sent = ""
+	putTimer(t, timer, `{"name": "Modified"}`, http.StatusOK)
+	if sent != "" {
+		t.Error("Unexpected message", sent)
+	}
+
+	// The kick token still works
+	kickTimerWithToken(t, timer, token)
+
+	// Kicked between reading the timer and updating it (read a second earlier)
+	stale := a.DB.GetTimer(timer.Id, testUser.Id)
+	stale.Kicked--
+	stale.Expiry--
+	interval := int64(300)
+	if err := stale.Update(&lib.TimerChanges{Interval: &interval}); err == nil {
+		t.Error("Stale timer updated")
+	}
+	if getTimer(t, timer).Interval != 120 {
+		t.Error("Stale update stored")
+	}
+
+	deleteTimer(t, timer2, true)
+}
+
+func doJSON(t *testing.T, method, url, p string, code int, v interface{}) {
+	req, _ := http.NewRequest(method, url, strings.NewReader(p))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(cookies[0])
+	rsp := executeRequest(req)
+	checkResponseCode(t, code, rsp.Code)
+	if v != nil && code == http.StatusOK {
+		if err := json.NewDecoder(rsp.Body).Decode(v); err != nil {
+			t.Error("JSON fail", err)
+		}
+	}
+}
+
+func TestChannels(t *testing.T) {
+	channels := []lib.Channel{}
+	doJSON(t, "GET", "/api/channel", "", http.StatusOK, &channels)
+	if len(channels) != 1 || channels[0].Name != lib.DefaultChannel || channels[0].Kind != "telegram" {
+		t.Error("Incorrect default channels", channels)
+	}
+
+	// Other chats are added with /bind only
+	doJSON(t, "POST", "/api/channel", `{"name": "team", "kind": "telegram", "config": {"chat_id": -555}}`, http.StatusBadRequest, nil)
+
+	// Second channel to the own chat
+	team := lib.Channel{}
+	doJSON(t, "POST", "/api/channel", fmt.Sprintf(`{"name": "team", "kind": "telegram", "config": {"chat_id": %d}}`, testUser.TgId), http.StatusOK, &team)
+	doJSON(t, "POST", "/api/channel", `{"name": "team", "kind": "telegram"}`, http.StatusBadRequest, nil)
+	doJSON(t, "POST", "/api/channel", `{"name": "pigeon", "kind": "pigeon"}`, http.StatusBadRequest, nil)
+
+	sent := []string{}
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		if tgid != testUser.TgId {
+			t.Error("Notification sent to", tgid)
+		}
+		sent = append(sent, msg)
+		return nil
+	}
+	timer := lib.Timer{}
+	doJSON(t, "POST", "/api/timer", `{"name": "Channels", "interval": 60}`, http.StatusOK, &timer)
+	if len(sent) != 2 || sent[0] != "Timer 'Channels' created" || sent[1] != "Timer 'Channels' created" {
+		t.Error("Notification not sent to both channels", sent)
+	}
+
+	// Deleting the channel removes it from the timers
+	routed := lib.Timer{}
+	doJSON(t, "POST", "/api/timer", `{"name": "Routed", "interval": 60, "channels": ["team"]}`, http.StatusOK, &routed)
+	doJSON(t, "DELETE", fmt.Sprintf("/api/channel/%d", team.Id), "", http.StatusOK, nil)
+	doJSON(t, "DELETE", fmt.Sprintf("/api/channel/%d", team.Id), "", http.StatusNotFound, nil)
+	if c := getTimer(t, routed).Channels; len(c) != 0 {
+		t.Error("Deleted channel left in timer", c)
+	}
+	routed = putTimer(t, routed, `{"name": "Rerouted"}`, http.StatusOK)
+
+	deleteTimer(t, routed, true)
+	deleteTimer(t, timer, true)
+}
+
+func TestOutbox(t *testing.T) {
+	lib.OutboxBackoff = 0
+	defer func() { lib.OutboxBackoff = 30 * time.Second }()
+
+	// Telegram is down
+	sent := []string{}
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		return fmt.Errorf("Telegram is down")
+	}
+	timer := lib.Timer{}
+	doJSON(t, "POST", "/api/timer", `{"name": "Outbox", "interval": 60}`, http.StatusOK, &timer)
+
+	pending := []lib.OutboxEntry{}
+	doJSON(t, "GET", "/api/outbox?state=pending", "", http.StatusOK, &pending)
+	if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].LastError != "Telegram is down" {
+		t.Fatal("Incorrect pending notifications", pending)
+	}
+
+	// Retries until given up
+	for i := 1; i < lib.OutboxMaxAttempts; i++ {
+		a.DB.ProcessOutbox()
+	}
+	dead := []lib.OutboxEntry{}
+	doJSON(t, "GET", "/api/outbox", "", http.StatusOK, &dead)
+	if len(dead) != 1 || dead[0].Attempts != lib.OutboxMaxAttempts || dead[0].Notification.Text != "Timer 'Outbox' created" {
+		t.Fatal("Incorrect dead notifications", dead)
+	}
+	doJSON(t, "GET", "/api/outbox?state=bogus", "", http.StatusBadRequest, nil)
+
+	// Telegram is back but slow, retry the dead notification. Overlapping
+	// workers deliver it once.
+	var mu sync.Mutex
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, msg)
+		return nil
+	}
+	doJSON(t, "POST", fmt.Sprintf("/api/outbox/%d/retry", dead[0].Id), "", http.StatusOK, nil)
+	doJSON(t, "POST", fmt.Sprintf("/api/outbox/%d/retry", dead[0].Id), "", http.StatusNotFound, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.DB.ProcessOutbox()
+		}()
+	}
+	wg.Wait()
+	if len(sent) != 1 || sent[0] != "Timer 'Outbox' created" {
+		t.Error("Notification not delivered", sent)
+	}
+	doJSON(t, "GET", "/api/outbox", "", http.StatusOK, &dead)
+	if len(dead) != 0 {
+		t.Error("Dead notifications left", dead)
+	}
+
+	deleteTimer(t, timer, true)
+}
+
+func kickWithToken(token string) int {
+	req, _ := http.NewRequest("GET", "/kick/"+token, nil)
+	return executeRequest(req).Code
+}
+
+func TestTokens(t *testing.T) {
+	timer := addTimer(t, "Tokens", 60)
+	path := fmt.Sprintf("/api/timer/%d/token", timer.Id)
+
+	// The default token stays the same
+	def := getTimerToken(t, timer)
+	if getTimerToken(t, timer) != def {
+		t.Error("Default token changed")
+	}
+
+	web1, web2 := lib.Token{}, lib.Token{}
+	doJSON(t, "POST", path, `{"name": "web1"}`, http.StatusOK, &web1)
+	doJSON(t, "POST", path, fmt.Sprintf(`{"name": "web2", "expiry": %d}`, time.Now().Unix()+1), http.StatusOK, &web2)
+	doJSON(t, "POST", path, `{"name": "web1"}`, http.StatusBadRequest, nil)
+	doJSON(t, "POST", path, `{"name": ""}`, http.StatusBadRequest, nil)
+	doJSON(t, "POST", path, `{"name": "old", "expiry": 1}`, http.StatusBadRequest, nil)
+
+	tokens := []lib.Token{}
+	doJSON(t, "GET", path+"s", "", http.StatusOK, &tokens)
+	if len(tokens) != 3 || tokens[0].Name != lib.DefaultTokenName || tokens[0].Token != def ||
+		!reflect.DeepEqual(tokens[1], web1) || !reflect.DeepEqual(tokens[2], web2) {
+		t.Error("Incorrect token list", tokens)
+	}
+
+	mockTelegram(t, testUser.TgId)
+	for _, token := range []string{def, web1.Token, web2.Token} {
+		checkResponseCode(t, http.StatusOK, kickWithToken(token))
+	}
+
+	// Revoked and expired tokens are rejected, the others still work
+	doJSON(t, "DELETE", fmt.Sprintf("%s/%d", path, web1.Id), "", http.StatusOK, nil)
+	doJSON(t, "DELETE", fmt.Sprintf("%s/%d", path, web1.Id), "", http.StatusNotFound, nil)
+	checkResponseCode(t, http.StatusBadRequest, kickWithToken(web1.Token))
+	time.Sleep(2 * time.Second)
+	checkResponseCode(t, http.StatusBadRequest, kickWithToken(web2.Token))
+	checkResponseCode(t, http.StatusOK, kickWithToken(def))
+
+	// Kick tokens are no sessions, whether revoked or not, and vice versa
+	for _, token := range []string{web1.Token, def} {
+		req, _ := http.NewRequest("GET", "/api/timer", nil)
+		req.AddCookie(&http.Cookie{Name: "Authorization", Value: token})
+		checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+	}
+	checkResponseCode(t, http.StatusBadRequest, kickWithToken(cookies[0].Value))
+
+	// Tokens without an ID are accepted only for timers from before the
+	// upgrade, see TestLegacyTokens
+	legacy, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"userid":  testUser.Id,
+		"timerid": timer.Id,
+	}).SignedString([]byte("secret"))
+	checkResponseCode(t, http.StatusBadRequest, kickWithToken(legacy))
+
+	// Tokens of a deleted timer are revoked
+	deleteTimer(t, timer, true)
+	checkResponseCode(t, http.StatusBadRequest, kickWithToken(def))
+}
+
+func TestLegacyTokens(t *testing.T) {
+	// Database from before the tokens were stored
+	path := "legacy_test.db"
+	os.Remove(path)
+	defer os.Remove(path)
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		`CREATE TABLE User (id INTEGER PRIMARY KEY AUTOINCREMENT, tgname TEXT NOT NULL, tgid TEXT NOT NULL UNIQUE, key TEXT NOT NULL, ts DATETIME DEFAULT CURRENT_TIMESTAMP)`,
+		`CREATE TABLE Timer (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, name TEXT NOT NULL, interval INTEGER NOT NULL, expiry INTEGER NOT NULL, state TEXT NOT NULL, ts DATETIME DEFAULT CURRENT_TIMESTAMP)`,
+		`INSERT INTO User (tgname, tgid, key) VALUES ('Old', '456', 'oldkey')`,
+		`INSERT INTO Timer (user_id, name, interval, expiry, state) VALUES (1, 'Old', 60, 0, 'new')`,
+	} {
+		if _, err := old.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.Close()
+
+	db := lib.NewDatabase(path)
+	db.Init()
+	defer db.Close()
+	rest := lib.NewRestServer("", db, "secret")
+	kick := func(token string) int {
+		req, _ := http.NewRequest("GET", "/kick/"+token, nil)
+		rsp := httptest.NewRecorder()
+		rest.ServeHTTP(rsp, req)
+		return rsp.Code
+	}
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"userid":  1,
+		"timerid": 1,
+	}).SignedString([]byte("secret"))
+	mockTelegram(t, 456)
+	checkResponseCode(t, http.StatusOK, kick(token))
+	if s := db.GetTimer(1, 1).State; s != "running" {
+		t.Error("Timer not kicked", s)
+	}
+
+	k := db.GetTokenByName(1, 1, lib.LegacyTokenName)
+	if k == nil {
+		t.Fatal("Legacy token missing")
+	}
+	if err := k.Revoke(); err != nil {
+		t.Fatal(err)
+	}
+	checkResponseCode(t, http.StatusBadRequest, kick(token))
+}
+
+func ping(method, key, slug string) int {
+	req, _ := http.NewRequest(method, "/ping/"+key+"/"+slug, nil)
+	return executeRequest(req).Code
+}
+
+func TestPing(t *testing.T) {
+	ps := lib.PingSettings{}
+	doJSON(t, "GET", "/api/ping", "", http.StatusOK, &ps)
+	if ps.PingKey == "" || ps.AutoCreate {
+		t.Fatal("Incorrect ping settings", ps)
+	}
+
+	timer := addTimer(t, "Nightly Backup!", 60)
+	other := addTimer(t, "nightly backup", 60)
+	mockTelegram(t, testUser.TgId)
+	if timer.Slug != "nightly-backup" || other.Slug != "nightly-backup-2" {
+		t.Error("Incorrect slugs", timer.Slug, other.Slug)
+	}
+
+	for _, method := range []string{"GET", "HEAD", "POST"} {
+		checkResponseCode(t, http.StatusOK, ping(method, ps.PingKey, "nightly-backup"))
+	}
+	if s := getTimer(t, timer).State; s != "running" {
+		t.Error("Timer not kicked", s)
+	}
+	checkResponseCode(t, http.StatusNotFound, ping("GET", ps.PingKey+"x", "nightly-backup"))
+	checkResponseCode(t, http.StatusNotFound, ping("GET", ps.PingKey, "new-job"))
+
+	// Slugs can be modified
+	putTimer(t, timer, `{"slug": "nightly-backup-2"}`, http.StatusBadRequest)
+	putTimer(t, timer, `{"slug": "Backup"}`, http.StatusBadRequest)
+	if x := putTimer(t, timer, `{"slug": "backup"}`, http.StatusOK); x.Slug != "backup" {
+		t.Error("Slug not modified", x.Slug)
+	}
+	checkResponseCode(t, http.StatusOK, ping("GET", ps.PingKey, "backup"))
+
+	// Timers created on the first ping
+	doJSON(t, "PUT", "/api/ping", `{"auto_create": true}`, http.StatusOK, &ps)
+	if !ps.AutoCreate {
+		t.Error("Auto create not enabled")
+	}
+	checkResponseCode(t, http.StatusOK, ping("GET", ps.PingKey, "new-job"))
+	created := a.DB.GetTimerBySlug(testUser.Id, "new-job")
+	if created == nil || created.Name != "new-job" || created.Interval != lib.AutoCreateInterval || created.State != "running" {
+		t.Error("Timer not created", created)
+	}
+	checkResponseCode(t, http.StatusNotFound, ping("GET", ps.PingKey, "New_Job"))
+
+	// Old ping URLs stop working when the key is rotated
+	old := ps.PingKey
+	doJSON(t, "POST", "/api/ping/key", "", http.StatusOK, &ps)
+	if ps.PingKey == old {
+		t.Error("Ping key not rotated")
+	}
+	checkResponseCode(t, http.StatusNotFound, ping("GET", old, "backup"))
+	checkResponseCode(t, http.StatusOK, ping("GET", ps.PingKey, "backup"))
+
+	doJSON(t, "PUT", "/api/ping", `{"auto_create": false}`, http.StatusOK, &ps)
+	deleteTimer(t, timer, true)
+	deleteTimer(t, other, true)
+	deleteTimer(t, *created, true)
+}
+
+func TestHealthchecksPing(t *testing.T) {
+	ps := lib.PingSettings{}
+	doJSON(t, "GET", "/api/ping", "", http.StatusOK, &ps)
+	timer := addTimer(t, "HC", 60)
+	other := addTimer(t, "Other", 60)
+	if len(timer.UUID) != 36 || timer.UUID == other.UUID {
+		t.Fatal("Invalid UUIDs", timer.UUID, other.UUID)
+	}
+	mockTelegram(t, testUser.TgId)
+
+	byUUID := "/ping/" + timer.UUID
+	bySlug := "/ping/" + ps.PingKey + "/hc"
+	for _, tc := range []struct {
+		method string
+		path   string
+		code   int
+		state  string
+	}{
+		{"GET", byUUID, http.StatusOK, "running"},
+		{"POST", byUUID + "/start", http.StatusOK, "started"},
+		{"HEAD", byUUID + "/0", http.StatusOK, "running"},
+		{"GET", byUUID + "/fail", http.StatusOK, "failed"},
+		{"POST", byUUID, http.StatusOK, "running"},
+		{"GET", byUUID + "/3", http.StatusOK, "failed"},
+		{"GET", byUUID + "/256", http.StatusBadRequest, "failed"},
+		{"GET", byUUID + "/x", http.StatusBadRequest, "failed"},
+		{"GET", byUUID + "/start/x", http.StatusNotFound, "failed"},
+		{"GET", bySlug + "/start", http.StatusOK, "started"},
+		{"POST", bySlug + "/fail", http.StatusOK, "failed"},
+		{"HEAD", bySlug + "/0", http.StatusOK, "running"},
+		{"GET", bySlug + "/1", http.StatusOK, "failed"},
+		{"GET", bySlug, http.StatusOK, "running"},
+		{"GET", bySlug + "/x", http.StatusBadRequest, "running"},
+		{"GET", "/ping/" + other.UUID + "x", http.StatusNotFound, "running"},
+	} {
+		req, _ := http.NewRequest(tc.method, tc.path, strings.NewReader("job output"))
+		rsp := executeRequest(req)
+		if rsp.Code != tc.code {
+			t.Errorf("%s %s: expected code %d, got %d", tc.method, tc.path, tc.code, rsp.Code)
+		}
+		if s := getTimer(t, timer).State; s != tc.state {
+			t.Errorf("%s %s: expected state %s, got %s", tc.method, tc.path, tc.state, s)
+		}
+	}
+
+	if s := getTimer(t, other).State; s != "new" {
+		t.Error("Other timer pinged", s)
+	}
+
+	// A new UUID revokes the old ping URLs
+	rotated := lib.Timer{}
+	doJSON(t, "POST", fmt.Sprintf("/api/timer/%d/uuid", timer.Id), "", http.StatusOK, &rotated)
+	if rotated.UUID == "" || rotated.UUID == timer.UUID || getTimer(t, timer).UUID != rotated.UUID {
+		t.Error("UUID not replaced", rotated.UUID)
+	}
+	for uuid, code := range map[string]int{timer.UUID: http.StatusNotFound, rotated.UUID: http.StatusOK} {
+		req, _ := http.NewRequest("GET", "/ping/"+uuid, nil)
+		checkResponseCode(t, code, executeRequest(req).Code)
+	}
+
+	deleteTimer(t, timer, true)
+	deleteTimer(t, other, true)
+}
+
+func TestEvents(t *testing.T) {
+	timer := addTimer(t, "Events", 60)
+	token := getTimerToken(t, timer)
+	mockTelegram(t, testUser.TgId)
+
+	kickTimer(t, timer)
+	kickTimer(t, timer)
+	for _, path := range []string{"/start", "/3", ""} {
+		req, _ := http.NewRequest("GET", "/kick/"+token+path, nil)
+		req.Header.Set("User-Agent", "cron/1.0")
+		req.RemoteAddr = "192.0.2.1:1234"
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	}
+
+	path := fmt.Sprintf("/api/timer/%d/events", timer.Id)
+	events := []lib.Event{}
+	doJSON(t, "GET", path, "", http.StatusOK, &events)
+	expected := []struct {
+		eType string
+		from  string
+		state string
+	}{
+		{"recovered", "failed", "running"},
+		{"failed", "started", "failed"},
+		{"started", "running", "started"},
+		{"kicked", "running", "running"},
+		{"kicked", "new", "running"},
+		{"created", "", "new"},
+	}
+	if len(events) != len(expected) {
+		t.Fatal("Incorrect events", events)
+	}
+	for i, e := range expected {
+		x := events[i]
+		if x.Type != e.eType || x.From != e.from || x.State != e.state || x.TimerId != timer.Id {
+			t.Errorf("Event %d: expected %v, got %v", i, e, x)
+		}
+	}
+	if e := events[1]; e.ExitCode != 3 || e.UserAgent != "cron/1.0" || e.SourceIP != "192.0.2.1" {
+		t.Error("Incorrect failure event", e)
+	}
+	if e := events[3]; e.ExitCode != lib.NoExitCode || e.UserAgent != "" {
+		t.Error("Incorrect kick event", e)
+	}
+
+	// Pages of two events
+	page := []lib.Event{}
+	doJSON(t, "GET", path+"?limit=2", "", http.StatusOK, &page)
+	if len(page) != 2 || page[0].Id != events[0].Id || page[1].Id != events[1].Id {
+		t.Error("Incorrect first page", page)
+	}
+	doJSON(t, "GET", fmt.Sprintf("%s?limit=2&before=%d", path, page[1].Id), "", http.StatusOK, &page)
+	if len(page) != 2 || page[0].Id != events[2].Id || page[1].Id != events[3].Id {
+		t.Error("Incorrect second page", page)
+	}
+	doJSON(t, "GET", path+"?limit=0", "", http.StatusBadRequest, nil)
+	doJSON(t, "GET", path+"?before=x", "", http.StatusBadRequest, nil)
+
+	deleteTimer(t, timer, true)
+}
+
+func TestReport(t *testing.T) {
+	timer := addTimer(t, "Report", 60)
+	token := getTimerToken(t, timer)
+	mockTelegram(t, testUser.TgId)
+
+	start := time.Now().Unix()
+	kickTimerWithToken(t, timer, token)
+	for _, path := range []string{"/fail", "", "/fail"} {
+		time.Sleep(2 * time.Second)
+		req, _ := http.NewRequest("GET", "/kick/"+token+path, nil)
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	}
+	time.Sleep(time.Second)
+
+	path := fmt.Sprintf("/api/timer/%d/report", timer.Id)
+	var r lib.Report
+	doJSON(t, "GET", fmt.Sprintf("%s?from=%d", path, start), "", http.StatusOK, &r)
+	if r.TimerId != timer.Id || r.From != start || r.Incidents != 2 {
+		t.Fatal("Incorrect report", r)
+	}
+	if r.MTTR < 1 || r.MTTR > 3 || r.LongestOutage < r.MTTR || r.Downtime < r.MTTR {
+		t.Error("Incorrect outage durations", r)
+	}
+	if r.Uptime <= 0 || r.Uptime >= 100 || r.Monitored < 5 {
+		t.Error("Incorrect uptime", r)
+	}
+
+	// Range before the first failure
+	doJSON(t, "GET", fmt.Sprintf("%s?from=%d&to=%d", path, start-3600, start+1), "", http.StatusOK, &r)
+	if r.Incidents != 0 || r.Downtime != 0 || r.Uptime != 100 {
+		t.Error("Incorrect report before failure", r)
+	}
+
+	reports := []lib.Report{}
+	doJSON(t, "GET", "/api/report", "", http.StatusOK, &reports)
+	found := false
+	for _, x := range reports {
+		if x.TimerId == timer.Id {
+			found = x.Incidents == 2
+		}
+	}
+	if !found {
+		t.Error("Timer missing from summary", reports)
+	}
+
+	doJSON(t, "GET", path+"?from=x", "", http.StatusBadRequest, nil)
+	doJSON(t, "GET", fmt.Sprintf("%s?from=%d&to=%d", path, start, start), "", http.StatusBadRequest, nil)
+
+	deleteTimer(t, timer, true)
+}
+
 func TestAPIWithoutCookie(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/api/timer", nil)
 	response := executeRequest(req)
@@ -287,6 +1228,40 @@ func TestLoginFail(t *testing.T) {
 	checkResponseCode(t, http.StatusUnauthorized, rsp.Code)
 }
 
+func TestRotateKey(t *testing.T) {
+	oldKey, oldCookies := testUser.Key, cookies
+
+	req, _ := http.NewRequest("POST", "/api/key", nil)
+	req.AddCookie(cookies[0])
+	rsp := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rsp.Code)
+	var r struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&r); err != nil || r.Key == "" || r.Key == oldKey {
+		t.Fatal("Key not rotated", r, err)
+	}
+	testUser.Key = r.Key
+
+	// The rotating session continues with a new cookie
+	cookies = rsp.Result().Cookies()
+	doJSON(t, "GET", "/api/timer", "", http.StatusOK, nil)
+
+	// Old sessions and the old key are revoked
+	req, _ = http.NewRequest("GET", "/api/timer", nil)
+	req.AddCookie(oldCookies[0])
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+
+	form := url.Values{}
+	form.Add("key", oldKey)
+	req, _ = http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+
+	cookies = getCookies()
+	doJSON(t, "GET", "/api/timer", "", http.StatusOK, nil)
+}
+
 func getCookies() []*http.Cookie {
 	form := url.Values{}
 	form.Add("key", testUser.Key)
@@ -312,9 +1287,10 @@ func checkResponseCode(t *testing.T, expected, actual int) {
 }
 
 func mockTelegram(t *testing.T, tgidExpected int64) {
-	lib.SendTelegramMsg = func(tgid int64, msg string) {
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
 		if tgid != tgidExpected {
 			t.Errorf("SendTelegramMsg - Expected id %d, got %d\n", tgidExpected, tgid)
 		}
+		return nil
 	}
 }
@@ -0,0 +1,99 @@
+package main_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pkorpine/go-watchdog/internal/lib"
+)
+
+// getMetrics returns the samples of the /metrics endpoint by series, using
+// the metrics token if set.
+func getMetrics(t *testing.T) map[string]float64 {
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	if lib.MetricsToken != "" {
+		req.Header.Set("Authorization", "Bearer "+lib.MetricsToken)
+	}
+	rsp := executeRequest(req)
+	checkResponseCode(t, http.StatusOK, rsp.Code)
+
+	samples := map[string]float64{}
+	for _, line := range strings.Split(rsp.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatal("Invalid sample", line)
+		}
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	before := getMetrics(t)
+	if _, ok := before[`watchdog_timers{state="paused"}`]; !ok {
+		t.Error("Missing timer state", before)
+	}
+
+	timer := addTimerJSON(t, `Metric "quoted"`, `{"name": "Metric \"quoted\"", "interval": 60}`)
+	mockTelegram(t, testUser.TgId)
+	kickTimer(t, timer)
+	a.DB.ProcessExpiredTimers()
+
+	// The kick has no message for Telegram, so it is not queued
+	sent := []lib.OutboxEntry{}
+	doJSON(t, "GET", "/api/outbox?state=sent", "", http.StatusOK, &sent)
+	if len(sent) == 0 || sent[0].Notification.Type != lib.NotifyCreated {
+		t.Error("Kick queued", sent)
+	}
+
+	// Failed deliveries are counted by the channel kind
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		return errors.New("Telegram down")
+	}
+	postTimer(t, timer, "pause", http.StatusOK)
+	mockTelegram(t, testUser.TgId)
+
+	after := getMetrics(t)
+	series := fmt.Sprintf(`watchdog_timer_expiry_seconds{timerid="%d",user="%d",name="Metric \"quoted\"",state="running"}`, timer.Id, testUser.Id)
+	for _, tc := range []struct {
+		series string
+		delta  float64
+	}{
+		{`watchdog_timers{state="paused"}`, 1},
+		{`watchdog_kicks_total`, 1},
+		{`watchdog_expires_total`, 0},
+		{`watchdog_notifications_total{kind="telegram",result="success"}`, 1},
+		{`watchdog_notifications_total{kind="telegram",result="failure"}`, 1},
+		{`watchdog_process_expired_duration_seconds_count`, 1},
+	} {
+		if d := after[tc.series] - before[tc.series]; d != tc.delta {
+			t.Errorf("%s: expected change %g, got %g", tc.series, tc.delta, d)
+		}
+	}
+	if _, ok := after[series]; ok {
+		t.Error("Expiry of a paused timer", series)
+	}
+
+	// Timer names are shown only to an authenticated scraper
+	postTimer(t, timer, "resume", http.StatusOK)
+	if _, ok := getMetrics(t)[series]; ok {
+		t.Error("Timer expiry without a token", series)
+	}
+	lib.MetricsToken = "scraper"
+	defer func() { lib.MetricsToken = "" }()
+	if v, ok := getMetrics(t)[series]; !ok || v < 55 || v > 60 {
+		t.Error("Incorrect timer expiry", v, ok)
+	}
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+
+	deleteTimer(t, timer, true)
+}
@@ -0,0 +1,400 @@
+package main_test
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkorpine/go-watchdog/internal/lib"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// testBot runs the real bot handlers without a network connection. Its
+// methods send a message to the bot or press an inline button as the sender
+// in the chat, and return the messages sent by the service meanwhile. The
+// answer to a button press is the first message.
+type testBot struct {
+	bot    *tb.Bot
+	sender *tb.User
+	chat   *tb.Chat
+}
+
+// startTestBot returns a test bot chatting privately with the test user.
+func startTestBot(t *testing.T) *testBot {
+	lib.NewTelegramBot = func(s tb.Settings) (*tb.Bot, error) {
+		s.Offline = true
+		s.Synchronous = true
+		return tb.NewBot(s)
+	}
+	initTelegram("token", a.DB)
+	bot := lib.Tg
+	lib.Tg = nil
+
+	return &testBot{
+		bot:    bot,
+		sender: &tb.User{ID: testUser.TgId, Username: testUser.Name},
+		chat:   &tb.Chat{ID: testUser.TgId, Type: tb.ChatPrivate},
+	}
+}
+
+// in returns a copy of the bot where the user chats in another chat.
+func (b *testBot) in(sender *tb.User, chat *tb.Chat) *testBot {
+	return &testBot{bot: b.bot, sender: sender, chat: chat}
+}
+
+func (b *testBot) send(text string) []string {
+	replies := []string{}
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		replies = append(replies, msg)
+		return nil
+	}
+	b.bot.ProcessUpdate(tb.Update{Message: &tb.Message{
+		Text:   text,
+		Sender: b.sender,
+		Chat:   b.chat,
+	}})
+	return replies
+}
+
+func (b *testBot) press(unique, data string) []string {
+	replies := []string{""}
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		replies = append(replies, msg)
+		return nil
+	}
+	lib.AnswerTelegramCallback = func(c *tb.Callback, text string) error {
+		replies[0] = text
+		return nil
+	}
+	b.bot.ProcessUpdate(tb.Update{Callback: &tb.Callback{
+		ID:      "1",
+		Sender:  b.sender,
+		Message: &tb.Message{Sender: b.sender, Chat: b.chat},
+		Data:    "\f" + unique + "|" + data,
+	}})
+	return replies
+}
+
+func TestBotCommands(t *testing.T) {
+	bot := startTestBot(t)
+
+	for _, tc := range []struct {
+		text    string
+		replies []string
+	}{
+		{"/list", []string{"No timers"}},
+		{"/new Nightly backup 1h", []string{"Timer 'Nightly backup' created", "Timer 'Nightly backup' created, kick it to start"}},
+		{"/new Broken", []string{"Usage: /new <name> <interval>"}},
+		{"/list", []string{"Nightly backup: new"}},
+		{"/kick Nightly backup", []string{"Timer 'Nightly backup' kicked"}},
+		{"/kick Nope", []string{"Timer 'Nope' not found"}},
+		{"/status", []string{"Usage: /status <name>"}},
+		{"/pause Nightly backup", []string{"Timer 'Nightly backup' paused", "Timer 'Nightly backup' paused"}},
+		{"/status Nightly backup", []string{"Nightly backup: paused\nInterval: 1h0m0s\nLast kick: "}},
+		{"/resume Nightly backup", []string{"Timer 'Nightly backup' resumed", "Timer 'Nightly backup' resumed"}},
+		{"/resume Nightly backup", []string{"Timer is not paused"}},
+		{"/delete Nightly backup", []string{"Timer 'Nightly backup' deleted", "Timer 'Nightly backup' deleted"}},
+		{"/list", []string{"No timers"}},
+	} {
+		replies := bot.send(tc.text)
+		if len(replies) != len(tc.replies) {
+			t.Errorf("%s: expected replies %q, got %q", tc.text, tc.replies, replies)
+			continue
+		}
+		for i := range replies {
+			if !strings.HasPrefix(replies[i], tc.replies[i]) {
+				t.Errorf("%s: expected reply %q, got %q", tc.text, tc.replies[i], replies[i])
+			}
+		}
+	}
+
+	// Running timer in the list
+	bot.send("/new Job 60")
+	bot.send("/kick Job")
+	if r := bot.send("/list"); len(r) != 1 || !strings.HasPrefix(r[0], "Job: running, expires in ") {
+		t.Error("Incorrect list", r)
+	}
+	bot.send("/delete Job")
+}
+
+func TestAlertButtons(t *testing.T) {
+	bot := startTestBot(t)
+
+	timer := addTimerJSON(t, "Alert", `{"name": "Alert", "interval": 60, "reminder": 1}`)
+	token := getTimerToken(t, timer)
+	id := strconv.FormatInt(timer.Id, 10)
+
+	// The alert carries the buttons
+	var keyboard *tb.ReplyMarkup
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		if len(options) == 1 {
+			keyboard, _ = options[0].(*tb.ReplyMarkup)
+		}
+		return nil
+	}
+	req, _ := http.NewRequest("GET", "/kick/"+token+"/fail", nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	if keyboard == nil || len(keyboard.InlineKeyboard) != 1 || len(keyboard.InlineKeyboard[0]) != 3 {
+		t.Fatal("Alert without buttons", keyboard)
+	}
+	for _, b := range keyboard.InlineKeyboard[0] {
+		if b.Data != id {
+			t.Error("Incorrect button data", b)
+		}
+	}
+
+	for _, tc := range []struct {
+		unique  string
+		data    string
+		replies []string
+	}{
+		{"ack", "x", []string{"Timer not found"}},
+		{"ack", id, []string{"Timer 'Alert' acknowledged", "Timer 'Alert' acknowledged by @" + testUser.Name}},
+		{"snooze", id, []string{"Timer 'Alert' snoozed for 1h", "Timer 'Alert' snoozed for 1h0m0s by @" + testUser.Name}},
+		{"ack", id, []string{"Timer 'Alert' acknowledged", "Timer 'Alert' acknowledged by @" + testUser.Name}},
+	} {
+		replies := bot.press(tc.unique, tc.data)
+		if !reflect.DeepEqual(replies, tc.replies) {
+			t.Errorf("%s %s: expected replies %q, got %q", tc.unique, tc.data, tc.replies, replies)
+		}
+	}
+
+	// No reminders once acknowledged
+	x := getTimer(t, timer)
+	if x.AckedBy != "@"+testUser.Name || x.Acked == 0 || x.NextReminder != 0 {
+		t.Error("Timer not acknowledged", x)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if n := a.DB.ProcessReminders(); n != 0 {
+		t.Error("Reminders sent after acknowledgement", n)
+	}
+
+	// Kicking clears the acknowledgement
+	replies := bot.press("kick", id)
+	if len(replies) != 2 || replies[0] != "Timer 'Alert' kicked" || !strings.HasPrefix(replies[1], "Timer 'Alert' recovered after ") {
+		t.Error("Incorrect kick replies", replies)
+	}
+	if x := getTimer(t, timer); x.State != "running" || x.Acked != 0 || x.AckedBy != "" {
+		t.Error("Timer not kicked", x)
+	}
+	if r := bot.press("ack", id); r[0] != "Timer is not down" {
+		t.Error("Acknowledged a running timer", r)
+	}
+
+	deleteTimer(t, timer, true)
+}
+
+func TestGroupChat(t *testing.T) {
+	bot := startTestBot(t)
+	group := &tb.Chat{ID: -1001, Type: tb.ChatGroup, Title: "Ops"}
+	owner := bot.in(bot.sender, group)
+
+	for _, tc := range []struct {
+		bot     *testBot
+		text    string
+		replies []string
+	}{
+		{bot, "/bind", []string{"Use /bind in a group chat"}},
+		{owner, "/bind", []string{"Chat bound as channel 'Ops', add it to the channels of a timer to send its alerts here"}},
+		{owner, "/bind Team", []string{"This chat is already bound as channel 'Ops'"}},
+	} {
+		if replies := tc.bot.send(tc.text); !reflect.DeepEqual(replies, tc.replies) {
+			t.Errorf("%s: expected replies %q, got %q", tc.text, tc.replies, replies)
+		}
+	}
+
+	// Alerts of the timer go to the group only
+	chats := map[int64]string{}
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		chats[tgid] = msg
+		return nil
+	}
+	timer := lib.Timer{}
+	doJSON(t, "POST", "/api/timer", `{"name": "Shared", "interval": 60, "channels": ["Ops"]}`, http.StatusOK, &timer)
+	token := getTimerToken(t, timer)
+	req, _ := http.NewRequest("GET", "/kick/"+token+"/fail", nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	if len(chats) != 1 || chats[group.ID] != "Timer 'Shared' failed" {
+		t.Error("Alert not sent to the group", chats)
+	}
+
+	// Any member of the bound group can handle the alert
+	id := strconv.FormatInt(timer.Id, 10)
+	teammate := &tb.User{ID: 4242, Username: "teammate"}
+	if r := bot.in(teammate, group).press("ack", id); len(r) != 2 || r[1] != "Timer 'Shared' acknowledged by @teammate" {
+		t.Error("Incorrect ack replies", r)
+	}
+	other := &tb.Chat{ID: -1002, Type: tb.ChatGroup, Title: "Other"}
+	if r := bot.in(teammate, other).press("kick", id); r[0] != "Timer not found" {
+		t.Error("Kicked from an unbound group", r)
+	}
+
+	// Timers not alerting the group cannot be handled from it, except by the owner
+	pager := lib.Channel{}
+	doJSON(t, "POST", "/api/channel", fmt.Sprintf(`{"name": "pager", "kind": "telegram", "config": {"chat_id": %d}}`, testUser.TgId), http.StatusOK, &pager)
+	private := addTimerJSON(t, "Private", `{"name": "Private", "interval": 60, "channels": ["pager"]}`)
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error { return nil }
+	privateId := strconv.FormatInt(private.Id, 10)
+	if r := bot.in(teammate, group).press("kick", privateId); r[0] != "Timer not found" {
+		t.Error("Kicked a timer not alerting the group", r)
+	}
+	if r := owner.press("kick", privateId); r[0] != "Timer 'Private' kicked" {
+		t.Error("Owner could not kick from the group", r)
+	}
+	deleteTimer(t, private, true)
+	doJSON(t, "DELETE", fmt.Sprintf("/api/channel/%d", pager.Id), "", http.StatusOK, nil)
+
+	if r := owner.send("/unbind"); len(r) != 1 || r[0] != "Chat unbound" {
+		t.Error("Incorrect unbind reply", r)
+	}
+	if r := owner.send("/unbind"); len(r) != 1 || r[0] != "This chat is not bound" {
+		t.Error("Incorrect unbind reply", r)
+	}
+	deleteTimer(t, timer, true)
+}
+
+func TestTelegramWebhook(t *testing.T) {
+	lib.TgWebhook = &lib.TelegramWebhookConfig{URL: "https://example.com", Secret: "s3cret"}
+	lib.Tg = startTestBot(t).bot
+	defer func() {
+		lib.Tg = nil
+		lib.TgWebhook = nil
+	}()
+
+	replies := []string{}
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		replies = append(replies, msg)
+		return nil
+	}
+
+	update := fmt.Sprintf(`{"update_id": 1, "message": {"message_id": 1,
+		"from": {"id": %d, "username": "%s"},
+		"chat": {"id": %d, "type": "private"},
+		"text": "/new Hooked 60"}}`, testUser.TgId, testUser.Name, testUser.TgId)
+	for _, tc := range []struct {
+		path string
+		body string
+		code int
+	}{
+		{"/telegram/wrong", update, http.StatusNotFound},
+		{"/telegram/s3cret", "{", http.StatusBadRequest},
+		{"/telegram/s3cret", update, http.StatusOK},
+	} {
+		req, _ := http.NewRequest("POST", tc.path, strings.NewReader(tc.body))
+		checkResponseCode(t, tc.code, executeRequest(req).Code)
+	}
+
+	if len(replies) != 2 || replies[1] != "Timer 'Hooked' created, kick it to start" {
+		t.Error("Update not processed", replies)
+	}
+	timer := a.DB.GetTimerByName(testUser.Id, "Hooked")
+	if timer == nil {
+		t.Fatal("Timer not created")
+	}
+	timer.Delete()
+}
+
+func TestNewKeyCommand(t *testing.T) {
+	bot := startTestBot(t)
+	group := &tb.Chat{ID: -1001, Type: tb.ChatGroup, Title: "Ops"}
+
+	if r := bot.in(bot.sender, group).send("/newkey"); len(r) != 1 || r[0] != "Use /newkey in a private chat" {
+		t.Error("Key rotated in a group", r)
+	}
+
+	oldCookies := cookies
+	r := bot.send("/newkey")
+	lines := strings.Split(strings.Join(r, ""), "\n")
+	if len(r) != 1 || len(lines) != 3 || lines[0] != "Your new access key:" || lines[1] == testUser.Key {
+		t.Fatal("Incorrect reply", r)
+	}
+	testUser.Key = lines[1]
+	cookies = getCookies()
+
+	req, _ := http.NewRequest("GET", "/api/timer", nil)
+	req.AddCookie(oldCookies[0])
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+	doJSON(t, "GET", "/api/timer", "", http.StatusOK, nil)
+}
+
+func TestDigest(t *testing.T) {
+	bot := startTestBot(t)
+
+	if r := bot.send("/digest"); len(r) != 1 || !strings.HasPrefix(r[0], "No digest scheduled") {
+		t.Error("Incorrect reply", r)
+	}
+	if r := bot.send("/digest 0 8 * * 1 Europe/Helsinki"); len(r) != 1 || !strings.HasPrefix(r[0], "Digest scheduled, next digest: ") {
+		t.Error("Incorrect reply", r)
+	}
+	var ds lib.DigestSettings
+	doJSON(t, "GET", "/api/digest", "", http.StatusOK, &ds)
+	if ds.Schedule != "0 8 * * 1" || ds.Timezone != "Europe/Helsinki" || ds.Next <= time.Now().Unix() {
+		t.Error("Incorrect digest settings", ds)
+	}
+	if r := bot.send("/digest 0 8 * * 1 Mars/Base"); len(r) != 1 || r[0] != "Invalid timezone 'Mars/Base'" {
+		t.Error("Incorrect reply", r)
+	}
+	doJSON(t, "PUT", "/api/digest", `{"schedule": "bogus"}`, http.StatusBadRequest, nil)
+
+	// Digest of a failed and a never kicked timer
+	doJSON(t, "PUT", "/api/digest", `{"schedule": "@every 1s"}`, http.StatusOK, &ds)
+	unused := addTimer(t, "Unused", 60)
+	broken := addTimer(t, "Broken", 60)
+	token := getTimerToken(t, broken)
+	mockTelegram(t, testUser.TgId)
+	kickTimerWithToken(t, broken, token)
+	req, _ := http.NewRequest("GET", "/kick/"+token+"/fail", nil)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	time.Sleep(1100 * time.Millisecond)
+
+	// Telegram is down, the digest is retried through the outbox
+	lib.OutboxBackoff = 0
+	defer func() { lib.OutboxBackoff = 30 * time.Second }()
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		return fmt.Errorf("Telegram is down")
+	}
+	if n := a.DB.ProcessDigests(); n != 1 {
+		t.Fatal("Expected one digest", n)
+	}
+	sent := []string{}
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		if tgid != testUser.TgId {
+			t.Error("Digest sent to", tgid)
+		}
+		sent = append(sent, msg)
+		return nil
+	}
+	a.DB.ProcessOutbox()
+	if len(sent) != 1 {
+		t.Fatal("Digest not delivered", sent)
+	}
+	for _, s := range []string{"Expired or failed:\n- Broken: 1 incident, down for ", "Never kicked:\n- Unused"} {
+		if !strings.Contains(sent[0], s) {
+			t.Errorf("Digest %q does not contain %q", sent[0], s)
+		}
+	}
+	if strings.Contains(sent[0], "Flapping") {
+		t.Error("Incorrect digest", sent[0])
+	}
+	if n := a.DB.ProcessDigests(); n != 0 {
+		t.Error("Digest sent twice")
+	}
+
+	if r := bot.send("/digest now"); len(r) != 1 || !strings.HasPrefix(r[0], "Digest ") {
+		t.Error("Incorrect reply", r)
+	}
+	if r := bot.send("/digest off"); len(r) != 1 || r[0] != "Digest disabled" {
+		t.Error("Incorrect reply", r)
+	}
+	doJSON(t, "GET", "/api/digest", "", http.StatusOK, &ds)
+	if ds.Schedule != "" || ds.Next != 0 {
+		t.Error("Digest not disabled", ds)
+	}
+
+	deleteTimer(t, unused, true)
+	deleteTimer(t, broken, true)
+}
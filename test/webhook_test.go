@@ -0,0 +1,80 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkorpine/go-watchdog/internal/lib"
+)
+
+func TestWebhook(t *testing.T) {
+	const secret = "hooksecret"
+	failures := 1
+	received := []lib.Notification{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(lib.WebhookSignatureHeader) != lib.WebhookSignature(secret, body) {
+			t.Error("Incorrect webhook signature")
+		}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		n := lib.Notification{}
+		if err := json.Unmarshal(body, &n); err != nil {
+			t.Error("JSON fail", err)
+		}
+		received = append(received, n)
+	}))
+	defer srv.Close()
+	lib.OutboxBackoff = 0
+	defer func() { lib.OutboxBackoff = 30 * time.Second }()
+
+	hook := lib.Channel{}
+	p := fmt.Sprintf(`{"name": "hook", "kind": "webhook", "config": {"url": "%s", "secret": "%s"}}`, srv.URL, secret)
+	doJSON(t, "POST", "/api/channel", p, http.StatusOK, &hook)
+	doJSON(t, "POST", "/api/channel", `{"name": "bad", "kind": "webhook", "config": {"url": "ftp://x", "secret": "s"}}`, http.StatusBadRequest, nil)
+	doJSON(t, "POST", "/api/channel", `{"name": "bad", "kind": "webhook", "config": {"url": "http://x"}}`, http.StatusBadRequest, nil)
+
+	// Only the webhook is notified
+	lib.SendTelegramMsg = func(tgid int64, msg string, options ...interface{}) error {
+		t.Error("SendTelegramMsg - unexpected message", msg)
+		return nil
+	}
+	timer := lib.Timer{}
+	doJSON(t, "POST", "/api/timer", `{"name": "Hooked", "interval": 60, "channels": ["hook"]}`, http.StatusOK, &timer)
+	if len(received) != 0 {
+		t.Fatal("First webhook call should have failed", received)
+	}
+	a.DB.ProcessOutbox()
+	doJSON(t, "POST", "/api/timer", `{"name": "Hooked", "interval": 60, "channels": ["nope"]}`, http.StatusBadRequest, nil)
+	kickTimer(t, timer)
+	postTimer(t, timer, "pause", http.StatusOK)
+
+	expected := []struct{ typ, from, state string }{
+		{lib.NotifyCreated, "", "new"},
+		{lib.NotifyKicked, "new", "running"},
+		{lib.NotifyPaused, "running", "paused"},
+	}
+	if len(received) != len(expected) {
+		t.Fatal("Incorrect webhook calls", received)
+	}
+	for i, e := range expected {
+		n := received[i]
+		if n.Type != e.typ || n.From != e.from || n.State != e.state || n.TimerId != timer.Id || n.Name != "Hooked" || n.Time == 0 {
+			t.Error("Incorrect webhook payload", i, n)
+		}
+	}
+	if received[1].Expiry == 0 {
+		t.Error("Expiry missing from webhook payload", received[1])
+	}
+
+	doJSON(t, "DELETE", fmt.Sprintf("/api/timer/%d", timer.Id), "", http.StatusOK, nil)
+	doJSON(t, "DELETE", fmt.Sprintf("/api/channel/%d", hook.Id), "", http.StatusOK, nil)
+}